@@ -0,0 +1,52 @@
+package opamppackagemgm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// AttrError reports an attribute of the old executable, or one demanded by
+// the manifest's FileAttrs, that couldn't be reproduced on the new one.
+type AttrError struct {
+	Attr string // ex: "mode", "owner", "xattr security.capability"
+	Err  error
+}
+
+func (e *AttrError) Error() string {
+	msg := fmt.Sprintf("cannot reproduce %s on the new executable: %v", e.Attr, e.Err)
+	if e.Privilege() {
+		msg += " (the updater lacks the privilege for it, run it as root or grant CAP_CHOWN/CAP_FOWNER/CAP_SETFCAP)"
+	}
+	return msg
+}
+
+func (e *AttrError) Unwrap() error {
+	return e.Err
+}
+
+// Privilege reports whether the attribute failed for lack of privilege.
+func (e *AttrError) Privilege() bool {
+	return errors.Is(e.Err, os.ErrPermission)
+}
+
+// attrPreparer returns the hook that gives the staged binary the
+// attributes of the executable at path, adjusted by Info.FileAttrs. Unless
+// AttrBestEffort is set any attribute that can't be reproduced aborts the
+// install, so a setuid or capability-carrying binary is never silently
+// replaced by one without.
+func (u *Updater) attrPreparer(path string) func(newPath string) error {
+	return func(newPath string) error {
+		errs := copyFileAttrs(path, newPath, u.Info.FileAttrs)
+		if !u.AttrBestEffort {
+			return errors.Join(errs...)
+		}
+		for _, err := range errs {
+			u.logger().Log(zapcore.WarnLevel, "attribute of the old executable not reproduced",
+				zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		}
+		return nil
+	}
+}
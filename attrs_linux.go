@@ -0,0 +1,124 @@
+package opamppackagemgm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrCapability holds file capabilities. The kernel drops it on chown,
+// so it is written last.
+const xattrCapability = "security.capability"
+
+// copyFileAttrs gives dst the mode (including setuid/setgid), owner and
+// extended attributes (SELinux label, file capabilities, ...) of src, with
+// the fields set in policy taking precedence. Every attribute that can't be
+// reproduced is returned as an *AttrError.
+func copyFileAttrs(src, dst string, policy *FileAttrs) []error {
+	var st unix.Stat_t
+	if err := unix.Stat(src, &st); err != nil {
+		return []error{err}
+	}
+	if policy == nil {
+		policy = &FileAttrs{}
+	}
+	var errs []error
+
+	// owner first: chown clears setuid/setgid and file capabilities
+	uid, gid := int(st.Uid), int(st.Gid)
+	if policy.Uid != nil {
+		uid = *policy.Uid
+	}
+	if policy.Gid != nil {
+		gid = *policy.Gid
+	}
+	var cur unix.Stat_t
+	if err := unix.Stat(dst, &cur); err != nil {
+		return []error{err}
+	}
+	if int(cur.Uid) != uid || int(cur.Gid) != gid {
+		if err := unix.Chown(dst, uid, gid); err != nil {
+			errs = append(errs, &AttrError{Attr: fmt.Sprintf("owner %d:%d", uid, gid), Err: err})
+		}
+	}
+
+	mode := st.Mode & 07777
+	if policy.Mode != nil {
+		mode = *policy.Mode & 07777
+	}
+	if err := unix.Chmod(dst, mode); err != nil {
+		errs = append(errs, &AttrError{Attr: fmt.Sprintf("mode %#o", mode), Err: err})
+	} else if err := unix.Stat(dst, &cur); err == nil && cur.Mode&07777 != mode {
+		// chmod silently drops setgid for a group the caller isn't in
+		errs = append(errs, &AttrError{
+			Attr: fmt.Sprintf("mode %#o", mode),
+			Err:  fmt.Errorf("kernel left it at %#o: %w", cur.Mode&07777, unix.EPERM),
+		})
+	}
+
+	xattrs, err := listXattrs(src)
+	if err != nil {
+		errs = append(errs, &AttrError{Attr: "xattrs", Err: err})
+	}
+	for name, value := range policy.Xattrs {
+		if len(value) == 0 {
+			delete(xattrs, name)
+			continue
+		}
+		xattrs[name] = value
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		if name != xattrCapability {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := xattrs[xattrCapability]; ok {
+		names = append(names, xattrCapability)
+	}
+	for _, name := range names {
+		if err := unix.Setxattr(dst, name, xattrs[name], 0); err != nil {
+			errs = append(errs, &AttrError{Attr: "xattr " + name, Err: err})
+		}
+	}
+	return errs
+}
+
+// listXattrs reads all extended attributes of path.
+func listXattrs(path string) (map[string][]byte, error) {
+	xattrs := map[string][]byte{}
+	size, err := unix.Listxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return xattrs, nil
+	}
+	if err != nil || size == 0 {
+		return xattrs, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return xattrs, err
+	}
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		n, err := unix.Getxattr(path, name, nil)
+		if errors.Is(err, unix.ENODATA) {
+			continue
+		}
+		if err != nil {
+			return xattrs, err
+		}
+		value := make([]byte, n)
+		if n, err = unix.Getxattr(path, name, value); err != nil {
+			return xattrs, err
+		}
+		xattrs[name] = value[:n]
+	}
+	return xattrs, nil
+}
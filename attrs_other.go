@@ -0,0 +1,48 @@
+//go:build !linux
+
+package opamppackagemgm
+
+import (
+	"errors"
+	"os"
+)
+
+// copyFileAttrs gives dst the mode of src, or the one set in policy. Owner
+// and extended attributes are only reproduced on linux; asking for them
+// explicitly elsewhere is reported as an *AttrError.
+func copyFileAttrs(src, dst string, policy *FileAttrs) []error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	mode := fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if policy != nil && policy.Mode != nil {
+		mode = fileMode(*policy.Mode)
+	}
+	if err := os.Chmod(dst, mode); err != nil {
+		errs = append(errs, &AttrError{Attr: "mode", Err: err})
+	}
+	if policy != nil && (policy.Uid != nil || policy.Gid != nil) {
+		errs = append(errs, &AttrError{Attr: "owner", Err: errors.ErrUnsupported})
+	}
+	if policy != nil && len(policy.Xattrs) > 0 {
+		errs = append(errs, &AttrError{Attr: "xattrs", Err: errors.ErrUnsupported})
+	}
+	return errs
+}
+
+// fileMode converts unix permission bits to an os.FileMode.
+func fileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,193 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpirySkew renews OAuth2 tokens a little before they expire so a
+// request doesn't race the expiry.
+const tokenExpirySkew = 30 * time.Second
+
+// Authenticator adds credentials to an outgoing request.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// Refresher is implemented by authenticators whose credentials can be
+// renewed. HTTPRequester calls Refresh once after a 401 and retries.
+type Refresher interface {
+	Refresh(ctx context.Context) error
+}
+
+// BasicAuth sends HTTP basic credentials.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a *BasicAuth) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+// BearerToken sends a fixed bearer token.
+type BearerToken struct {
+	Token string
+}
+
+func (a *BearerToken) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+// BearerTokenFile sends the bearer token stored in Path. The file is read
+// again whenever its modification time or size changes, so an external
+// agent can rotate short lived tokens in place.
+type BearerTokenFile struct {
+	Path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func NewBearerTokenFile(path string) *BearerTokenFile {
+	return &BearerTokenFile{Path: path}
+}
+
+func (a *BearerTokenFile) Authenticate(req *http.Request) error {
+	token, err := a.load(false)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Refresh re-reads the file even if it looks unchanged.
+func (a *BearerTokenFile) Refresh(ctx context.Context) error {
+	_, err := a.load(true)
+	return err
+}
+
+func (a *BearerTokenFile) load(force bool) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fi, err := os.Stat(a.Path)
+	if err != nil {
+		return "", err
+	}
+	if !force && a.token != "" && fi.ModTime().Equal(a.modTime) && fi.Size() == a.size {
+		return a.token, nil
+	}
+	p, err := os.ReadFile(a.Path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(p))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", a.Path)
+	}
+	a.token, a.modTime, a.size = token, fi.ModTime(), fi.Size()
+	return token, nil
+}
+
+// OAuth2ClientCredentials obtains bearer tokens with the OAuth2 client
+// credentials grant and caches them until shortly before they expire.
+type OAuth2ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Client       *http.Client // optional, defaults to http.DefaultClient
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func NewOAuth2ClientCredentials(tokenURL, clientID, clientSecret string, scopes ...string) *OAuth2ClientCredentials {
+	return &OAuth2ClientCredentials{
+		TokenURL:     tokenURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       scopes,
+	}
+}
+
+func (a *OAuth2ClientCredentials) Authenticate(req *http.Request) error {
+	token, err := a.get(req.Context(), false)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Refresh drops the cached token and requests a new one.
+func (a *OAuth2ClientCredentials) Refresh(ctx context.Context) error {
+	_, err := a.get(ctx, true)
+	return err
+}
+
+func (a *OAuth2ClientCredentials) get(ctx context.Context, force bool) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !force && a.token != "" && (a.expiry.IsZero() || time.Now().Before(a.expiry)) {
+		return a.token, nil
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.TokenURL, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", &StatusError{URL: a.TokenURL, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access_token")
+	}
+	if body.TokenType != "" && !strings.EqualFold(body.TokenType, "bearer") {
+		return "", fmt.Errorf("unsupported token type %q", body.TokenType)
+	}
+	a.token = body.AccessToken
+	a.expiry = time.Time{}
+	if body.ExpiresIn > 0 {
+		a.expiry = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - tokenExpirySkew)
+	}
+	return a.token, nil
+}
@@ -0,0 +1,330 @@
+package opamppackagemgm
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Bundle formats understood by the updater.
+const (
+	BundleTarGz  = "tar.gz"
+	BundleTarZst = "tar.zst"
+	BundleZip    = "zip"
+)
+
+// maxSymlinkTarget bounds the target of a symlink stored in a zip entry.
+const maxSymlinkTarget = 4096
+
+var (
+	ErrNoBundleDir       = errors.New("update is a bundle but the updater has no BundleDir")
+	ErrUnsafeBundleEntry = errors.New("unsafe bundle entry")
+)
+
+// Bundle describes an artifact that is an archive of several files, ex:
+// the agent with its config directory, plugins and helpers, instead of a
+// single executable. It is extracted and swapped in as a whole directory.
+type Bundle struct {
+	Format string `json:"format"` // BundleTarGz, BundleTarZst or BundleZip
+	Main   string `json:"main"`   // slash separated path of the main executable inside the bundle, ex: "bin/agent"
+}
+
+// installBundle extracts the verified archive next to BundleDir, runs the
+// pre-install hook in it and swaps the result in for BundleDir. The main
+// executable gets the attributes of the one it replaces.
+func (u *Updater) installBundle(ctx context.Context, exe string, archive []byte) (err error, errRecover error) {
+	if u.BundleDir == "" {
+		return ErrNoBundleDir, nil
+	}
+	dir := u.bundleDir()
+	newDir, _ := stagingPaths(dir)
+	if err = os.RemoveAll(newDir); err != nil {
+		return
+	}
+	if err = extractBundle(archive, u.Info.Bundle.Format, newDir); err != nil {
+		_ = os.RemoveAll(newDir)
+		return
+	}
+	newMain, err := bundleMain(newDir, u.Info.Bundle.Main)
+	if err != nil {
+		_ = os.RemoveAll(newDir)
+		return
+	}
+	oldMain := filepath.Join(dir, filepath.FromSlash(u.Info.Bundle.Main))
+	if _, statErr := os.Stat(oldMain); statErr == nil {
+		if err = u.attrPreparer(oldMain)(newMain); err != nil {
+			_ = os.RemoveAll(newDir)
+			return
+		}
+	}
+	if err = u.runHook(ctx, HookPreInstall, newDir, exe); err != nil {
+		_ = os.RemoveAll(newDir)
+		return
+	}
+	u.stage(dir)
+	return installDir(dir, newDir)
+}
+
+// bundleDir is BundleDir resolved against the executable's directory.
+func (u *Updater) bundleDir() string {
+	if filepath.IsAbs(u.BundleDir) {
+		return u.BundleDir
+	}
+	return u.getExecRelativeDir(u.BundleDir)
+}
+
+// bundleMain checks that the main entry was extracted as a regular file.
+func bundleMain(dir, main string) (string, error) {
+	if main == "" || !filepath.IsLocal(filepath.FromSlash(main)) {
+		return "", fmt.Errorf("bundle main entry %q: %w", main, ErrUnsafeBundleEntry)
+	}
+	p := filepath.Join(dir, filepath.FromSlash(main))
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return "", fmt.Errorf("bundle main entry %q: %w", main, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("bundle main entry %q is not a regular file", main)
+	}
+	return p, nil
+}
+
+// swapDirs replaces dir with newDir by moving dir aside to oldDir first,
+// putting it back if the second rename fails.
+func swapDirs(dir, newDir, oldDir string) (err error, errRecover error) {
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		// first install of the bundle
+		return os.Rename(newDir, dir), nil
+	}
+	if err = os.Rename(dir, oldDir); err != nil {
+		_ = os.RemoveAll(newDir)
+		return
+	}
+	if err = os.Rename(newDir, dir); err != nil {
+		errRecover = os.Rename(oldDir, dir)
+	}
+	return
+}
+
+// extractBundle unpacks archive into dir, which must not exist yet.
+func extractBundle(archive []byte, format, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	x := &bundleExtractor{dir: dir, links: map[string]bool{}}
+	var err error
+	switch format {
+	case BundleTarGz:
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(bytes.NewReader(archive)); err != nil {
+			return err
+		}
+		err = x.tar(gz)
+	case BundleTarZst:
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(bytes.NewReader(archive)); err != nil {
+			return err
+		}
+		defer zr.Close()
+		err = x.tar(zr)
+	case BundleZip:
+		err = x.zip(archive)
+	default:
+		return fmt.Errorf("unknown bundle format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	return x.checkLinks()
+}
+
+// bundleExtractor writes archive entries below dir. Entry names must be
+// local paths, they are never written through a symlink, and every
+// symlink must resolve inside dir once extraction is complete.
+type bundleExtractor struct {
+	dir   string
+	links map[string]bool // cleaned names of the symlinks created so far
+}
+
+// path returns where the entry called name goes.
+func (x *bundleExtractor) path(name string) (string, string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if !filepath.IsLocal(filepath.FromSlash(clean)) || strings.Contains(name, `\`) {
+		return "", "", fmt.Errorf("%w: %q escapes the bundle", ErrUnsafeBundleEntry, name)
+	}
+	for p := path.Dir(clean); p != "."; p = path.Dir(p) {
+		if x.links[p] {
+			return "", "", fmt.Errorf("%w: %q is below the symlink %q", ErrUnsafeBundleEntry, name, p)
+		}
+	}
+	if x.links[clean] {
+		return "", "", fmt.Errorf("%w: %q would replace a symlink", ErrUnsafeBundleEntry, name)
+	}
+	return clean, filepath.Join(x.dir, filepath.FromSlash(clean)), nil
+}
+
+func (x *bundleExtractor) mkdir(name string) error {
+	_, p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+func (x *bundleExtractor) file(name string, mode os.FileMode, r io.Reader) error {
+	_, p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fp, r); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+func (x *bundleExtractor) symlink(name, target string) error {
+	clean, p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if path.IsAbs(target) || !filepath.IsLocal(filepath.FromSlash(path.Join(path.Dir(clean), target))) {
+		return fmt.Errorf("%w: symlink %q points outside the bundle", ErrUnsafeBundleEntry, name)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink(filepath.FromSlash(target), p); err != nil {
+		return err
+	}
+	x.links[clean] = true
+	return nil
+}
+
+func (x *bundleExtractor) hardlink(name, target string) error {
+	_, p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	_, t, err := x.path(target)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(t); err != nil || !fi.Mode().IsRegular() {
+		return fmt.Errorf("%w: hard link %q to a missing or special file", ErrUnsafeBundleEntry, name)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.Link(t, p)
+}
+
+// checkLinks resolves every symlink, catching chains that only leave the
+// bundle once combined.
+func (x *bundleExtractor) checkLinks() error {
+	root, err := filepath.EvalSymlinks(x.dir)
+	if err != nil {
+		return err
+	}
+	for name := range x.links {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(x.dir, filepath.FromSlash(name)))
+		if err != nil {
+			return fmt.Errorf("%w: symlink %q: %v", ErrUnsafeBundleEntry, name, err)
+		}
+		if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("%w: symlink %q resolves outside the bundle", ErrUnsafeBundleEntry, name)
+		}
+	}
+	return nil
+}
+
+func (x *bundleExtractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.mkdir(hdr.Name)
+		case tar.TypeReg:
+			err = x.file(hdr.Name, os.FileMode(hdr.Mode), tr)
+		case tar.TypeSymlink:
+			err = x.symlink(hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			err = x.hardlink(hdr.Name, hdr.Linkname)
+		case tar.TypeXGlobalHeader:
+		default:
+			err = fmt.Errorf("%w: %q has unsupported type %q", ErrUnsafeBundleEntry, hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *bundleExtractor) zip(archive []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if err := x.zipEntry(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *bundleExtractor) zipEntry(f *zip.File) error {
+	mode := f.Mode()
+	if mode.IsDir() {
+		return x.mkdir(f.Name)
+	}
+	if mode&^(os.ModePerm|os.ModeSymlink) != 0 {
+		return fmt.Errorf("%w: %q has unsupported mode %v", ErrUnsafeBundleEntry, f.Name, mode)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if mode&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(io.LimitReader(rc, maxSymlinkTarget))
+		if err != nil {
+			return err
+		}
+		return x.symlink(f.Name, string(target))
+	}
+	if mode.Perm() == 0 {
+		// archives made on windows carry no unix permissions
+		mode |= 0644
+	}
+	return x.file(f.Name, mode, rc)
+}
@@ -0,0 +1,228 @@
+package opamppackagemgm
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// bundleEntry is one entry of a test archive.
+type bundleEntry struct {
+	name string
+	typ  byte   // tar.TypeReg, tar.TypeDir, tar.TypeSymlink or tar.TypeLink
+	link string // target of a symlink or hard link
+	body string
+}
+
+func regEntry(name, body string) bundleEntry {
+	return bundleEntry{name: name, typ: tar.TypeReg, body: body}
+}
+
+func symlinkEntry(name, target string) bundleEntry {
+	return bundleEntry{name: name, typ: tar.TypeSymlink, link: target}
+}
+
+func hardlinkEntry(name, target string) bundleEntry {
+	return bundleEntry{name: name, typ: tar.TypeLink, link: target}
+}
+
+func tarGzBundle(t *testing.T, entries []bundleEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Linkname: e.link, Mode: 0755, Size: int64(len(e.body))}
+		if e.typ != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typ == tar.TypeReg {
+			tw.Write([]byte(e.body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zipBundle writes entries as a zip, which has no hard links.
+func zipBundle(t *testing.T, entries []bundleEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		body := e.body
+		switch e.typ {
+		case tar.TypeReg:
+			hdr.SetMode(0755)
+		case tar.TypeDir:
+			hdr.SetMode(fs.ModeDir | 0755)
+		case tar.TypeSymlink:
+			hdr.SetMode(fs.ModeSymlink | 0777)
+			body = e.link
+		default:
+			t.Fatalf("zip has no entries of type %q", e.typ)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func skipWithoutSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("symlinks in bundles are not tested on " + runtime.GOOS)
+	}
+}
+
+func TestExtractBundleRejectsUnsafeEntries(t *testing.T) {
+	skipWithoutSymlinks(t)
+	tests := []struct {
+		name    string
+		entries []bundleEntry
+		tarOnly bool
+	}{
+		{name: "parent path", entries: []bundleEntry{regEntry("../x", "escaped")}},
+		{name: "nested parent path", entries: []bundleEntry{regEntry("bin/../../x", "escaped")}},
+		{name: "absolute path", entries: []bundleEntry{regEntry("/abs", "escaped")}},
+		{name: "backslash path", entries: []bundleEntry{regEntry(`..\x`, "escaped")}},
+		{name: "symlink outside", entries: []bundleEntry{symlinkEntry("link", "../x")}},
+		{name: "absolute symlink", entries: []bundleEntry{symlinkEntry("link", "/etc")}},
+		{
+			// each link stays inside on its own, together they leave
+			name:    "symlink chain outside",
+			entries: []bundleEntry{symlinkEntry("sub/up", ".."), symlinkEntry("escape", "sub/up/..")},
+		},
+		{
+			name:    "write through symlinked parent",
+			entries: []bundleEntry{symlinkEntry("sub", "."), regEntry("sub/x", "through the link")},
+		},
+		{
+			name:    "replace symlink",
+			entries: []bundleEntry{symlinkEntry("link", "bin"), regEntry("link", "over the link")},
+		},
+		{name: "hardlink outside", entries: []bundleEntry{hardlinkEntry("h", "../x")}, tarOnly: true},
+		{name: "absolute hardlink", entries: []bundleEntry{hardlinkEntry("h", "/etc/passwd")}, tarOnly: true},
+		{
+			name:    "hardlink through symlinked parent",
+			entries: []bundleEntry{symlinkEntry("sub", "."), regEntry("a", "inside"), hardlinkEntry("h", "sub/a")},
+			tarOnly: true,
+		},
+	}
+	formats := []struct {
+		format string
+		build  func(*testing.T, []bundleEntry) []byte
+	}{
+		{BundleTarGz, tarGzBundle},
+		{BundleZip, zipBundle},
+	}
+	for _, f := range formats {
+		for _, tt := range tests {
+			if tt.tarOnly && f.format != BundleTarGz {
+				continue
+			}
+			t.Run(f.format+"/"+tt.name, func(t *testing.T) {
+				root := t.TempDir()
+				// "../x" from the bundle lands in root/outside
+				outside := filepath.Join(root, "outside")
+				dir := filepath.Join(outside, "bundle")
+				if err := os.MkdirAll(outside, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(outside, "x"), []byte("untouched"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				err := extractBundle(f.build(t, tt.entries), f.format, dir)
+				if !errors.Is(err, ErrUnsafeBundleEntry) {
+					t.Fatalf("got %v, want ErrUnsafeBundleEntry", err)
+				}
+				entries, _ := os.ReadDir(outside)
+				if len(entries) != 2 {
+					t.Errorf("%d entries next to the bundle, want only x and the bundle", len(entries))
+				}
+				if p, _ := os.ReadFile(filepath.Join(outside, "x")); string(p) != "untouched" {
+					t.Errorf("file outside the bundle overwritten: %q", p)
+				}
+			})
+		}
+	}
+}
+
+func TestInstallBundle(t *testing.T) {
+	skipWithoutSymlinks(t)
+	formats := []struct {
+		format string
+		build  func(*testing.T, []bundleEntry) []byte
+	}{
+		{BundleTarGz, tarGzBundle},
+		{BundleZip, zipBundle},
+	}
+	for _, f := range formats {
+		t.Run(f.format, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "agent")
+			if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "bin", "agent"), []byte("v1"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			entries := []bundleEntry{
+				{name: "bin/", typ: tar.TypeDir},
+				regEntry("bin/agent", "v2"),
+				regEntry("conf/agent.yaml", "level: info"),
+				symlinkEntry("current.yaml", "conf/agent.yaml"),
+			}
+			if f.format == BundleTarGz {
+				entries = append(entries, hardlinkEntry("bin/agent-link", "bin/agent"))
+			}
+			u := &Updater{
+				BundleDir: dir,
+				Logger:    nopLog{},
+				Info:      UpdatePackageInfo{Bundle: &Bundle{Format: f.format, Main: "bin/agent"}},
+			}
+			err, errRecover := u.installBundle(context.Background(), filepath.Join(dir, "bin", "agent"), f.build(t, entries))
+			if err != nil || errRecover != nil {
+				t.Fatal(err, errRecover)
+			}
+			for name, want := range map[string]string{"bin/agent": "v2", "current.yaml": "level: info"} {
+				if p, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); err != nil || string(p) != want {
+					t.Errorf("%s: %q, %v, want %q", name, p, err, want)
+				}
+			}
+			// the previous bundle stays for a rollback until the update is confirmed
+			_, oldDir := stagingPaths(dir)
+			if p, err := os.ReadFile(filepath.Join(oldDir, "bin", "agent")); err != nil || string(p) != "v1" {
+				t.Errorf("previous bundle: %q, %v", p, err)
+			}
+			if err := rollbackInstall(dir); err != nil {
+				t.Fatal(err)
+			}
+			if p, _ := os.ReadFile(filepath.Join(dir, "bin", "agent")); string(p) != "v1" {
+				t.Errorf("after rollback bin/agent is %q, want v1", p)
+			}
+		})
+	}
+}
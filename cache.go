@@ -0,0 +1,256 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cachePath        = "cache"
+	cacheObjectsPath = "objects"
+	cachePatchesPath = "patches"
+	cacheLockPath    = ".lock"
+
+	// DefaultCacheMaxBytes is a size limit for WithDefaultCache.
+	DefaultCacheMaxBytes = 64 << 20
+)
+
+var (
+	ErrCacheMiss = errors.New("artifact not in cache")
+	errLockHeld  = errors.New("lock is held by another process")
+)
+
+// ArtifactCache is a content addressable store of verified binaries and
+// patches. Objects are named by their SHA-256 and checked again on every
+// read; the least recently used ones are evicted once MaxBytes is
+// exceeded. An advisory file lock makes it safe to share between several
+// processes on one host.
+//
+// Layout:
+//
+//	objects/<sha256>          binaries and patches
+//	patches/<source>-<target> sha256 of the patch turning source into target
+type ArtifactCache struct {
+	Dir      string
+	MaxBytes int64 // 0 means no limit
+}
+
+func NewArtifactCache(dir string, maxBytes int64) *ArtifactCache {
+	return &ArtifactCache{Dir: dir, MaxBytes: maxBytes}
+}
+
+// withLock runs fn holding the cache lock, shared or exclusive.
+func (c *ArtifactCache) withLock(exclusive bool, fn func() error) error {
+	if err := os.MkdirAll(filepath.Join(c.Dir, cacheObjectsPath), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(c.Dir, cachePatchesPath), 0755); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(filepath.Join(c.Dir, cacheLockPath), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := lockFile(fp, exclusive, false); err != nil {
+		return err
+	}
+	defer unlockFile(fp)
+	return fn()
+}
+
+func (c *ArtifactCache) objectPath(hash []byte) string {
+	return filepath.Join(c.Dir, cacheObjectsPath, hex.EncodeToString(hash))
+}
+
+func (c *ArtifactCache) patchIndexPath(source, target []byte) string {
+	return filepath.Join(c.Dir, cachePatchesPath, hex.EncodeToString(source)+"-"+hex.EncodeToString(target))
+}
+
+// Get returns the object with the given hash. A corrupt object is removed
+// and reported as a miss.
+func (c *ArtifactCache) Get(hash []byte) ([]byte, error) {
+	var bin []byte
+	err := c.withLock(false, func() (err error) {
+		bin, err = c.get(hash)
+		return
+	})
+	return bin, err
+}
+
+func (c *ArtifactCache) get(hash []byte) ([]byte, error) {
+	path := c.objectPath(hash)
+	bin, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !verifySha(bin, hash) {
+		_ = os.Remove(path)
+		return nil, ErrCacheMiss
+	}
+	// the modification time is the LRU clock
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return bin, nil
+}
+
+// Open implements ArtifactStore so a PeerServer can serve from the cache.
+func (c *ArtifactCache) Open(hash []byte) (io.ReadCloser, int64, error) {
+	bin, err := c.Get(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(bin)), int64(len(bin)), nil
+}
+
+// Put stores bin under hash after checking that they match.
+func (c *ArtifactCache) Put(hash []byte, bin []byte) error {
+	if !verifySha(bin, hash) {
+		return ErrHashMismatch
+	}
+	return c.withLock(true, func() error {
+		if err := c.put(hash, bin); err != nil {
+			return err
+		}
+		return c.evict()
+	})
+}
+
+func (c *ArtifactCache) put(hash []byte, bin []byte) error {
+	path := c.objectPath(hash)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := writeFileAtomic(path, bin, 0644); err != nil {
+			return err
+		}
+	}
+	// stamp explicitly, the kernel's write timestamps are coarser than the
+	// ones get sets and would make new objects look older
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// GetPatch returns a cached patch that turns source into target.
+func (c *ArtifactCache) GetPatch(source, target []byte) ([]byte, error) {
+	var patch []byte
+	err := c.withLock(false, func() error {
+		ref, err := ioutil.ReadFile(c.patchIndexPath(source, target))
+		if os.IsNotExist(err) {
+			return ErrCacheMiss
+		}
+		if err != nil {
+			return err
+		}
+		hash, err := hex.DecodeString(strings.TrimSpace(string(ref)))
+		if err != nil {
+			return ErrCacheMiss
+		}
+		patch, err = c.get(hash)
+		return err
+	})
+	return patch, err
+}
+
+// PutPatch stores a patch that has been verified to turn source into
+// target.
+func (c *ArtifactCache) PutPatch(source, target []byte, patch []byte) error {
+	sum := sha256.Sum256(patch)
+	return c.withLock(true, func() error {
+		if err := c.put(sum[:], patch); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(c.patchIndexPath(source, target), []byte(hex.EncodeToString(sum[:])), 0644); err != nil {
+			return err
+		}
+		return c.evict()
+	})
+}
+
+// evict removes the least recently used objects until the cache fits in
+// MaxBytes, and drops patch index entries whose object is gone.
+func (c *ArtifactCache) evict() error {
+	objectsDir := filepath.Join(c.Dir, cacheObjectsPath)
+	entries, err := ioutil.ReadDir(objectsDir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	objects := entries[:0]
+	for _, fi := range entries {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		total += fi.Size()
+		objects = append(objects, fi)
+	}
+	if c.MaxBytes > 0 && total > c.MaxBytes {
+		sort.Slice(objects, func(i, j int) bool {
+			return objects[i].ModTime().Before(objects[j].ModTime())
+		})
+		for _, fi := range objects {
+			if total <= c.MaxBytes {
+				break
+			}
+			if err := os.Remove(filepath.Join(objectsDir, fi.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			total -= fi.Size()
+		}
+	}
+
+	patchesDir := filepath.Join(c.Dir, cachePatchesPath)
+	refs, err := ioutil.ReadDir(patchesDir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range refs {
+		ref, err := ioutil.ReadFile(filepath.Join(patchesDir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(objectsDir, strings.TrimSpace(string(ref)))); os.IsNotExist(err) {
+			_ = os.Remove(filepath.Join(patchesDir, fi.Name()))
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data next to path and renames it into place so
+// readers never observe a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
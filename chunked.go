@@ -0,0 +1,204 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultChunkConcurrency is the number of ranges fetched at once.
+const DefaultChunkConcurrency = 4
+
+// Chunk is a byte range of the artifact together with its SHA-256.
+type Chunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Hash   []byte `json:"hash"`
+}
+
+// RangeRequester is implemented by requesters that can fetch part of a
+// resource, such as HTTPRequester and FileRequester, and by the requesters
+// wrapping them, which fail if the wrapped one can't.
+type RangeRequester interface {
+	FetchRange(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error)
+}
+
+// chunkedDownload fetches the artifact described by chunks in parallel.
+// Chunks are spread over the mirrors, verified one by one, and a failed
+// chunk is retried on its own, moving on to the next mirror each time.
+type chunkedDownload struct {
+	requester   RangeRequester
+	mirrors     []string
+	chunks      []Chunk
+	concurrency int
+	policy      RetryPolicy
+	onProgress  func(Progress)
+
+	mu    sync.Mutex
+	done  int64 // bytes of the artifact received, less those of failed attempts
+	total int64
+	start time.Time
+	last  time.Time
+}
+
+func (d *chunkedDownload) run(ctx context.Context) ([]byte, error) {
+	if len(d.mirrors) == 0 || len(d.chunks) == 0 {
+		return nil, errors.New("nothing to download")
+	}
+	var size int64
+	for i, c := range d.chunks {
+		if c.Offset != size || c.Size <= 0 || len(c.Hash) != sha256.Size {
+			return nil, fmt.Errorf("chunk %d doesn't continue the chunk list", i)
+		}
+		size += c.Size
+	}
+	d.total = size
+	d.start = time.Now()
+	buf := make([]byte, size)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	concurrency := d.concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultChunkConcurrency
+	}
+	jobs := make(chan int)
+	errCh := make(chan error, 1)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := d.fetchChunk(ctx, i, buf); err != nil {
+					select {
+					case errCh <- fmt.Errorf("chunk %d: %w", i, err):
+					default:
+					}
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i := range d.chunks {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	select {
+	case err := <-errCh:
+		return nil, err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.report(true)
+	return buf, nil
+}
+
+// fetchChunk downloads chunk i into its place in buf. Each attempt starts
+// at a different mirror so chunks spread over all of them.
+func (d *chunkedDownload) fetchChunk(ctx context.Context, i int, buf []byte) error {
+	c := d.chunks[i]
+	dst := buf[c.Offset : c.Offset+c.Size]
+	backoff := d.policy.InitialBackoff
+	var lastErr error
+	for attempt := 0; attempt < d.policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, backoff); err != nil {
+				return err
+			}
+			backoff *= 2
+			if d.policy.MaxBackoff > 0 && backoff > d.policy.MaxBackoff {
+				backoff = d.policy.MaxBackoff
+			}
+		}
+		url := d.mirrors[(i+attempt)%len(d.mirrors)]
+		n, err := d.readRange(ctx, url, c, dst)
+		if err == nil {
+			return nil
+		}
+		d.discard(n)
+		lastErr = err
+		if classifyError(err) == classFatal {
+			return err
+		}
+	}
+	return lastErr
+}
+
+func (d *chunkedDownload) readRange(ctx context.Context, url string, c Chunk, dst []byte) (int64, error) {
+	r, err := d.requester.FetchRange(ctx, url, c.Offset, c.Size)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	var n int64
+	for n < c.Size {
+		m, err := r.Read(dst[n:])
+		n += int64(m)
+		d.received(int64(m))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	if n != c.Size {
+		return n, io.ErrUnexpectedEOF
+	}
+	if !verifySha(dst, c.Hash) {
+		return n, ErrHashMismatch
+	}
+	return n, nil
+}
+
+func (d *chunkedDownload) received(n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.done += n
+	d.reportLocked(false)
+}
+
+// discard takes back the n bytes of a failed attempt. Done is reported
+// right before and after, so that a byteTally counts them once.
+func (d *chunkedDownload) discard(n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reportLocked(true)
+	d.done -= n
+	d.reportLocked(true)
+}
+
+func (d *chunkedDownload) report(final bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reportLocked(final)
+}
+
+func (d *chunkedDownload) reportLocked(final bool) {
+	if d.onProgress == nil {
+		return
+	}
+	now := time.Now()
+	if !final && now.Sub(d.last) < progressInterval {
+		return
+	}
+	d.last = now
+	p := Progress{Source: "full", URL: d.mirrors[0], Done: d.done, Total: d.total}
+	if elapsed := now.Sub(d.start).Seconds(); elapsed > 0 {
+		p.Rate = float64(p.Done) / elapsed
+	}
+	d.onProgress(p)
+}
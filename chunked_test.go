@@ -0,0 +1,109 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyRangeServer serves bin in ranges. The first request for chunk 1
+// gets garbled bytes and the first one for chunk 2 is cut off halfway;
+// served counts every byte sent.
+type flakyRangeServer struct {
+	bin    []byte
+	chunk  int64
+	served atomic.Int64
+	mu     sync.Mutex
+	failed map[int64]bool
+}
+
+func (s *flakyRangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	from, to, _ := strings.Cut(spec, "-")
+	start, err1 := strconv.ParseInt(from, 10, 64)
+	end, err2 := strconv.ParseInt(to, 10, 64)
+	if !ok || err1 != nil || err2 != nil {
+		http.Error(w, "ranges only", http.StatusBadRequest)
+		return
+	}
+	body := bytes.Clone(s.bin[start : end+1])
+	s.mu.Lock()
+	first := !s.failed[start]
+	s.failed[start] = true
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(s.bin)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusPartialContent)
+	switch {
+	case first && start == s.chunk:
+		for i := range body {
+			body[i] ^= 0xff
+		}
+	case first && start == 2*s.chunk:
+		body = body[:len(body)/2]
+	}
+	n, _ := w.Write(body)
+	s.served.Add(int64(n))
+}
+
+func TestChunkedRetriesCountedOnce(t *testing.T) {
+	const chunkSize = 16 << 10
+	bin := make([]byte, 4*chunkSize)
+	rand.New(rand.NewSource(3)).Read(bin)
+	var chunks []Chunk
+	for off := int64(0); off < int64(len(bin)); off += chunkSize {
+		sum := sha256.Sum256(bin[off : off+chunkSize])
+		chunks = append(chunks, Chunk{Offset: off, Size: chunkSize, Hash: sum[:]})
+	}
+	srv := &flakyRangeServer{bin: bin, chunk: chunkSize, failed: map[int64]bool{}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	hash := sha256.Sum256(bin)
+	var lastDone int64
+	u := &Updater{
+		Requester: NewHTTPRequester(),
+		Logger:    nopLog{},
+		Store:     NewMemoryStateStore(),
+		Retry:     &RetryPolicy{MaxAttempts: 3},
+		OnProgress: func(p Progress) {
+			if p.Done > p.Total {
+				t.Errorf("progress %d of %d", p.Done, p.Total)
+			}
+			lastDone = p.Done
+		},
+		Info: UpdatePackageInfo{
+			Version:     "2.0.0",
+			DownloadUrl: ts.URL + "/agent",
+			ContentHash: hash[:],
+			Compression: CompressionNone,
+			Chunks:      chunks,
+		},
+	}
+	var source string
+	var downloaded int64
+	got, err := u.fetchCounted(context.Background(), bytes.NewReader(nil), &source, &downloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bin) {
+		t.Fatal("downloaded a different binary")
+	}
+	if lastDone != int64(len(bin)) {
+		t.Errorf("last progress %d, want %d", lastDone, len(bin))
+	}
+	// the failed attempts were downloaded too, but only once
+	if served := srv.served.Load(); downloaded != served {
+		t.Errorf("counted %d bytes, the server sent %d", downloaded, served)
+	}
+}
@@ -0,0 +1,116 @@
+// patchbench compares the patch algorithms on a pair of real binaries,
+// typically two builds of the same Go program:
+//
+//	go build -o /tmp/old ./cmd/updater
+//	git checkout <newer> && go build -o /tmp/new ./cmd/updater
+//	go run ./cmd/patchbench /tmp/old /tmp/new
+//
+// For every algorithm it reports the patch size, the time to create and to
+// apply it, and the bytes allocated while applying it. The same
+// measurements run as benchmarks, which is what to track over time:
+//
+//	OPAMP_PATCHBENCH_OLD=/tmp/old OPAMP_PATCHBENCH_NEW=/tmp/new go test -run '^$' -bench Patch
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	opamppackagemgm "github.com/ploynomail/opamp-package-mgm"
+)
+
+type result struct {
+	algorithm opamppackagemgm.PatchAlgorithm
+	size      int
+	diff      time.Duration
+	apply     time.Duration
+	allocated uint64
+}
+
+func main() {
+	runs := flag.Int("runs", 5, "Number of times each patch is applied, the median time is reported")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: patchbench [-runs n] old-binary new-binary")
+		os.Exit(2)
+	}
+	old, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	new, err := os.ReadFile(flag.Arg(1))
+	if err != nil {
+		fail(err)
+	}
+
+	full, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		fail(err)
+	}
+	fullSize := len(full.EncodeAll(new, nil))
+
+	var results []result
+	for _, algorithm := range []opamppackagemgm.PatchAlgorithm{opamppackagemgm.PatchBsdiff, opamppackagemgm.PatchZstdFrom} {
+		r, err := bench(algorithm, old, new, *runs)
+		if err != nil {
+			fail(fmt.Errorf("%v: %w", algorithm, err))
+		}
+		results = append(results, r)
+	}
+
+	fmt.Printf("old %d bytes, new %d bytes, full artifact (zstd) %d bytes\n\n", len(old), len(new), fullSize)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "algorithm\tpatch bytes\tof full\tdiff\tapply\tapply alloc\t")
+	for _, r := range results {
+		fmt.Fprintf(w, "%v\t%d\t%.1f%%\t%v\t%v\t%d MiB\t\n",
+			r.algorithm, r.size, 100*float64(r.size)/float64(fullSize),
+			r.diff.Round(time.Millisecond), r.apply.Round(time.Millisecond), r.allocated>>20)
+	}
+	w.Flush()
+}
+
+func bench(algorithm opamppackagemgm.PatchAlgorithm, old, new []byte, runs int) (result, error) {
+	r := result{algorithm: algorithm}
+	start := time.Now()
+	patch, err := opamppackagemgm.DiffPatch(algorithm, old, new)
+	if err != nil {
+		return r, err
+	}
+	r.diff = time.Since(start)
+	r.size = len(patch)
+
+	want := sha256.Sum256(new)
+	times := make([]time.Duration, 0, runs)
+	for i := 0; i < runs; i++ {
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		bin, err := opamppackagemgm.ApplyPatch(old, patch)
+		if err != nil {
+			return r, err
+		}
+		times = append(times, time.Since(start))
+		runtime.ReadMemStats(&after)
+		r.allocated = after.TotalAlloc - before.TotalAlloc
+		if sum := sha256.Sum256(bin); !bytes.Equal(sum[:], want[:]) {
+			return r, fmt.Errorf("patched binary does not match")
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	r.apply = times[len(times)/2]
+	return r, nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -12,16 +15,72 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
-	"github.com/kr/binarydist"
+	"github.com/klauspost/compress/zstd"
+	opamppackagemgm "github.com/ploynomail/opamp-package-mgm"
+	"github.com/ulikunitz/xz"
 )
 
 var version, genDir, patchWith string
+var bundleMain, bundleFormat string
+var compression string
+var deltaAlgorithm opamppackagemgm.PatchAlgorithm
+var chunkSize int64
 
 type current struct {
-	Version string
-	Sha256  []byte
-	IsPatch bool
+	Version     string
+	Sha256      []byte
+	IsPatch     bool
+	Chunks      []chunk     `json:",omitempty"`
+	Bundle      *bundle     `json:",omitempty"`
+	Compression string      `json:",omitempty"`
+	Patches     []patchEdge `json:",omitempty"`
+}
+
+type patchEdge struct {
+	From []byte `json:"from"`
+	To   []byte `json:"to"`
+	Url  string `json:"url"`
+	Size int64  `json:"size,omitempty"`
+}
+
+// compressionExts maps the -compress codecs to the extension the updater
+// expects the artifact under.
+var compressionExts = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+	"xz":   ".xz",
+	"none": "",
+}
+
+type bundle struct {
+	Format string `json:"format"`
+	Main   string `json:"main"`
+}
+
+type chunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Hash   []byte `json:"hash"`
+}
+
+// chunkList splits the artifact into ranges of chunkSize bytes so the
+// updater can download and verify them in parallel.
+func chunkList(data []byte) []chunk {
+	if chunkSize <= 0 {
+		return nil
+	}
+	var chunks []chunk
+	for off := int64(0); off < int64(len(data)); off += chunkSize {
+		end := off + chunkSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		sum := sha256.Sum256(data[off:end])
+		chunks = append(chunks, chunk{Offset: off, Size: end - off, Hash: sum[:]})
+	}
+	return chunks
 }
 
 func generateSha256(path string) []byte {
@@ -36,100 +95,305 @@ func generateSha256(path string) []byte {
 	//return base64.URLEncoding.EncodeToString(sum)
 }
 
-type gzReader struct {
-	z, r io.ReadCloser
+// compress encodes data with the codec chosen by -compress.
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch compression {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	case "none":
+		return data
+	default:
+		err = fmt.Errorf("unknown compression %q", compression)
+	}
+	if err != nil {
+		panic(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil { // You must close this first to flush the bytes to the buffer.
+		panic(err)
+	}
+	return buf.Bytes()
 }
 
-func (g *gzReader) Read(p []byte) (int, error) {
-	return g.z.Read(p)
+// openRelease returns the decompressed binary of an earlier release,
+// whichever codec it was published with.
+func openRelease(dir, platform string) ([]byte, error) {
+	for _, ext := range []string{".gz", ".zst", ".xz", ""} {
+		data, err := os.ReadFile(filepath.Join(dir, platform+ext))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var r io.Reader
+		switch ext {
+		case ".gz":
+			r, err = gzip.NewReader(bytes.NewReader(data))
+		case ".zst":
+			var zr *zstd.Decoder
+			if zr, err = zstd.NewReader(bytes.NewReader(data)); err == nil {
+				defer zr.Close()
+				r = zr
+			}
+		case ".xz":
+			r, err = xz.NewReader(bytes.NewReader(data))
+		default:
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+	return nil, os.ErrNotExist
 }
 
-func (g *gzReader) Close() error {
-	g.z.Close()
-	return g.r.Close()
-}
+func createUpdate(path string, platform string) {
+	c := current{Version: version, Sha256: generateSha256(path), IsPatch: patchWith != ""}
 
-func newGzReader(r io.ReadCloser) io.ReadCloser {
-	var err error
-	g := new(gzReader)
-	g.r = r
-	g.z, err = gzip.NewReader(r)
+	newBin, err := os.ReadFile(path)
 	if err != nil {
 		panic(err)
 	}
-	return g
-}
+	artifact := compress(newBin)
+	ext := compressionExts[compression]
+	c.Chunks = chunkList(artifact)
+	c.Compression = compression
 
-func createUpdate(path string, platform string) {
-	c := current{Version: version, Sha256: generateSha256(path), IsPatch: patchWith != ""}
+	fileName := filepath.Base(path)
+	manifest := filepath.Join(genDir, fileName, platform+".json")
+	os.MkdirAll(filepath.Join(genDir, fileName, version), 0755)
+	if patchWith != "" {
+		c.Patches = createPatches(fileName, platform, newBin, c.Sha256, previousPatches(manifest))
+	}
 
 	b, err := json.MarshalIndent(c, "", "    ")
 	if err != nil {
 		fmt.Println("error:", err)
 	}
-	fileName := filepath.Base(path)
-	os.MkdirAll(filepath.Join(genDir, fileName, version), 0755)
-	err = os.WriteFile(filepath.Join(genDir, fileName, platform+".json"), b, 0755)
+	err = os.WriteFile(manifest, b, 0755)
 	if err != nil {
 		panic(err)
 	}
-	if patchWith == "" {
-		var buf bytes.Buffer
-		w := gzip.NewWriter(&buf)
-		f, err := os.ReadFile(path)
+	err = os.WriteFile(filepath.Join(genDir, fileName, version, platform+ext), artifact, 0755)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// previousPatches returns the patch graph of the release currently
+// described by manifest, so agents further behind can chain through it.
+func previousPatches(manifest string) []patchEdge {
+	b, err := os.ReadFile(manifest)
+	if err != nil {
+		return nil
+	}
+	var prev current
+	if err := json.Unmarshal(b, &prev); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't read %s, dropping its patches: %s\n", manifest, err)
+		return nil
+	}
+	return prev.Patches
+}
+
+// createPatches diffs the new binary against every version listed in
+// -patch and returns the carried over edges plus the new ones.
+func createPatches(fileName, platform string, newBin, newHash []byte, carried []patchEdge) []patchEdge {
+	var edges []patchEdge
+	for _, e := range carried {
+		if !bytes.Equal(e.To, newHash) {
+			edges = append(edges, e)
+		}
+	}
+	for _, from := range strings.Split(patchWith, ",") {
+		from = strings.TrimSpace(from)
+		dir := filepath.Join(genDir, fileName, from)
+		old, err := openRelease(dir, platform)
 		if err != nil {
-			panic(err)
+			fmt.Fprintf(os.Stderr, "Can't open %s: error: %s\n", filepath.Join(dir, platform), err)
+			// Don't have an old release for this os/arch, continue on
+			continue
 		}
-		w.Write(f)
-		w.Close() // You must close this first to flush the bytes to the buffer.
-
-		err = os.WriteFile(filepath.Join(genDir, fileName, version, platform+".gz"), buf.Bytes(), 0755)
+		patch, err := opamppackagemgm.DiffPatch(deltaAlgorithm, old, newBin)
 		if err != nil {
 			panic(err)
 		}
-	} else {
-		files, err := os.ReadDir(filepath.Join(genDir, fileName))
-		if err != nil {
-			fmt.Println(err)
+		// named after the binary it applies to, the updater asks for
+		// <platform>.<sha256 of its executable>.patch
+		sum := sha256.Sum256(old)
+		name := platform + "." + hex.EncodeToString(sum[:]) + ".patch"
+		if err = os.WriteFile(filepath.Join(genDir, fileName, version, name), patch, 0755); err != nil {
+			panic(err)
 		}
+		edges = append(edges, patchEdge{
+			From: sum[:],
+			To:   newHash,
+			Url:  "../" + version + "/" + name,
+			Size: int64(len(patch)),
+		})
+	}
+	return edges
+}
 
-		for _, file := range files {
-			if !file.IsDir() {
-				continue
+// createBundle packs the directory at path into a single archive whose
+// entry bundleMain is the executable the updater starts.
+func createBundle(path string, platform string) {
+	if _, err := os.Stat(filepath.Join(path, filepath.FromSlash(bundleMain))); err != nil {
+		fmt.Fprintf(os.Stderr, "bundle main entry: %s\n", err)
+		os.Exit(1)
+	}
+	if patchWith != "" {
+		fmt.Fprintln(os.Stderr, "patches are not supported for bundles, ignoring -patch")
+	}
+	var buf bytes.Buffer
+	var err error
+	switch bundleFormat {
+	case "tar.gz":
+		w := gzip.NewWriter(&buf)
+		if err = writeTar(w, path); err == nil {
+			err = w.Close()
+		}
+	case "tar.zst":
+		var w *zstd.Encoder
+		if w, err = zstd.NewWriter(&buf); err == nil {
+			if err = writeTar(w, path); err == nil {
+				err = w.Close()
 			}
+		}
+	case "zip":
+		err = writeZip(&buf, path)
+	default:
+		err = fmt.Errorf("unknown bundle format %q", bundleFormat)
+	}
+	if err != nil {
+		panic(err)
+	}
 
-			if file.Name() != patchWith {
-				continue
-			}
-			os.Mkdir(filepath.Join(genDir, file.Name(), version), 0755)
+	sum := sha256.Sum256(buf.Bytes())
+	c := current{
+		Version: version,
+		Sha256:  sum[:],
+		Chunks:  chunkList(buf.Bytes()),
+		Bundle:  &bundle{Format: bundleFormat, Main: bundleMain},
+	}
+	b, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		panic(err)
+	}
+	name := filepath.Base(filepath.Clean(path))
+	os.MkdirAll(filepath.Join(genDir, name, version), 0755)
+	if err = os.WriteFile(filepath.Join(genDir, name, platform+".json"), b, 0755); err != nil {
+		panic(err)
+	}
+	artifact := filepath.Join(genDir, name, version, platform+"."+bundleFormat)
+	if err = os.WriteFile(artifact, buf.Bytes(), 0755); err != nil {
+		panic(err)
+	}
+}
 
-			fName := filepath.Join(genDir, fileName, patchWith, platform+".gz")
-			old, err := os.Open(fName)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Can't open %s: error: %s\n", fName, err)
-				// Don't have an old release for this os/arch, continue on
-				continue
-			}
+// walkBundle calls fn for every entry below root with its slash separated
+// name, skipping root itself.
+func walkBundle(root string, fn func(name, path string, fi os.FileInfo) error) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), path, fi)
+	})
+}
 
-			// fName = filepath.Join(genDir, file.Name(), version, platform+".gz")
-			newF, err := os.Open(path)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Can't open %s: error: %s\n", fName, err)
-				os.Exit(1)
+func writeTar(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	err := walkBundle(root, func(name, path string, fi os.FileInfo) error {
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(path); err != nil {
+				return err
 			}
+			link = filepath.ToSlash(link)
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
 
-			ar := newGzReader(old)
-			defer ar.Close()
-			patch := new(bytes.Buffer)
-			if err := binarydist.Diff(ar, newF, patch); err != nil {
-				panic(err)
+func writeZip(w io.Writer, root string) error {
+	zw := zip.NewWriter(w)
+	err := walkBundle(root, func(name, path string, fi os.FileInfo) error {
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
 			}
-			err = os.WriteFile(filepath.Join(genDir, fileName, version, platform+".patch"), patch.Bytes(), 0755)
+			_, err = io.WriteString(fw, filepath.ToSlash(link))
+			return err
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
 			if err != nil {
-				panic(err)
+				return err
 			}
+			defer f.Close()
+			_, err = io.Copy(fw, f)
+			return err
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	return zw.Close()
 }
 
 func printUsage() {
@@ -137,6 +401,7 @@ func printUsage() {
 	fmt.Println("Positional arguments:")
 	fmt.Println("\tSingle platform: go-selfupdate myapp 1.2")
 	fmt.Println("\tCross platform: go-selfupdate /tmp/mybinares/ 1.2")
+	fmt.Println("\tBundle: go-selfupdate -main bin/myapp -format tar.zst /tmp/myapp/ 1.2")
 }
 
 func createBuildDir() {
@@ -145,7 +410,12 @@ func createBuildDir() {
 
 func main() {
 	outputDirFlag := flag.String("o", "public", "Output directory for writing updates")
-	patch := flag.String("patch", "", "Create a patch file from the given version")
+	patch := flag.String("patch", "", "Create patch files from the given comma separated versions, ex: 1.0,1.1")
+	chunkSizeFlag := flag.Int64("chunk-size", 4<<20, "Size in bytes of the verified ranges listed for parallel downloads, 0 disables")
+	mainFlag := flag.String("main", "", "Pack the given directory as one bundle whose main executable is this slash separated path inside it")
+	formatFlag := flag.String("format", "tar.gz", "Bundle format: tar.gz, tar.zst or zip")
+	compressFlag := flag.String("compress", "gzip", "Artifact compression: gzip, zstd, xz or none")
+	deltaFlag := flag.String("delta", "bsdiff", "Patch algorithm: bsdiff or zstd (patch-from, faster and lighter on large Go binaries)")
 	var defaultPlatform string
 	goos := os.Getenv("GOOS")
 	goarch := os.Getenv("GOARCH")
@@ -169,9 +439,27 @@ func main() {
 	version = flag.Arg(1)
 	genDir = *outputDirFlag
 	patchWith = *patch
+	chunkSize = *chunkSizeFlag
+	bundleMain = *mainFlag
+	bundleFormat = *formatFlag
+	compression = *compressFlag
+	var err error
+	if deltaAlgorithm, err = opamppackagemgm.ParsePatchAlgorithm(*deltaFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, ok := compressionExts[compression]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown compression %q\n", compression)
+		os.Exit(1)
+	}
 
 	createBuildDir()
 
+	if bundleMain != "" {
+		createBundle(appPath, platform)
+		os.Exit(0)
+	}
+
 	// If dir is given create update for each file
 	fi, err := os.Stat(appPath)
 	if err != nil {
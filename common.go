@@ -2,6 +2,7 @@ package opamppackagemgm
 
 import (
 	"errors"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -9,9 +10,21 @@ import (
 
 var (
 	ErrHashMismatch      = errors.New("new file hash mismatch after patch")
+	ErrIdleTimeout       = errors.New("download stalled: no data received within the idle timeout")
 	defaultHTTPRequester = &HTTPRequester{}
 )
 
+// Default limits of HTTPRequester, used when the matching field is zero.
+const (
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultHeaderTimeout  = 30 * time.Second
+	DefaultIdleTimeout    = 60 * time.Second
+
+	DefaultMaxIdleConns    = 100
+	DefaultMaxIdlePerHost  = 8
+	DefaultPoolIdleTimeout = 90 * time.Second
+)
+
 type Level int
 
 const (
@@ -49,7 +62,14 @@ func NewLog() Loggerr {
 }
 
 type Info struct {
-	Version string
-	Sha256  []byte
-	IsPatch bool
+	Version     string
+	Sha256      []byte
+	IsPatch     bool
+	Mirrors     []Mirror    `json:",omitempty"`
+	Chunks      []Chunk     `json:",omitempty"`
+	Bundle      *Bundle     `json:",omitempty"`
+	Compression string      `json:",omitempty"`
+	Patches     []PatchEdge `json:",omitempty"`
+	Hooks       *Hooks      `json:",omitempty"`
+	FileAttrs   *FileAttrs  `json:",omitempty"`
 }
@@ -0,0 +1,92 @@
+package opamppackagemgm
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Artifact compressions, as named by the manifest's Compression field.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionXz   = "xz"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// compressionExt is the file extension an artifact with the given
+// compression is published under, including the dot.
+func compressionExt(compression string) string {
+	switch compression {
+	case CompressionNone:
+		return ""
+	case CompressionZstd:
+		return ".zst"
+	case CompressionXz:
+		return ".xz"
+	}
+	return ".gz"
+}
+
+// sniffCompression recognises the compression of an artifact from its
+// first bytes. Executables don't start with any of the magic numbers.
+func sniffCompression(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return CompressionZstd
+	case bytes.HasPrefix(head, xzMagic):
+		return CompressionXz
+	}
+	return CompressionNone
+}
+
+// decompress copies r to w, undoing compression. An empty compression is
+// sniffed from the stream itself.
+func decompress(w io.Writer, r io.Reader, compression string) error {
+	if compression == "" {
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(len(xzMagic))
+		compression, r = sniffCompression(head), br
+	}
+	switch compression {
+	case CompressionNone:
+		_, err := io.Copy(w, r)
+		return err
+	case CompressionGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, gz)
+		return err
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		_, err = io.Copy(w, zr)
+		return err
+	case CompressionXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, xr)
+		return err
+	}
+	return fmt.Errorf("unknown compression %q", compression)
+}
@@ -2,6 +2,11 @@ package opamppackagemgm
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"go.uber.org/zap/zapcore"
 )
 
 func NewUpdater(
@@ -9,12 +14,27 @@ func NewUpdater(
 	currentVersion string,
 	tempDir string,
 ) *Updater {
-	u := &Updater{
+	return &Updater{
 		ctx:            ctx,
 		CurrentVersion: currentVersion,
 		Dir:            tempDir,
 		Requester:      NewHTTPRequester(),
 	}
+}
+
+// defaultCacheDir is where WithDefaultCache puts the artifact cache.
+func (u *Updater) defaultCacheDir() string {
+	return filepath.Join(u.getExecRelativeDir(u.Dir), cachePath)
+}
+
+// rebase runs set, which changes what Dir is relative to, and moves the
+// default cache along.
+func (u *Updater) rebase(set func()) *Updater {
+	moveCache := u.Cache != nil && u.Cache.Dir == u.defaultCacheDir()
+	set()
+	if moveCache {
+		u.Cache.Dir = u.defaultCacheDir()
+	}
 	return u
 }
 
@@ -43,7 +63,101 @@ func (u *Updater) WithOnFailedUpdate(f func(context.Context)) *Updater {
 	return u
 }
 
+// WithIsGzipped is kept for compatibility.
+//
+// Deprecated: compression is taken from the manifest or recognised from the
+// artifact, the flag has no effect.
 func (u *Updater) WithIsGzipped(b bool) *Updater {
 	u.IsGzipped = b
 	return u
 }
+
+func (u *Updater) WithRetryPolicy(p RetryPolicy) *Updater {
+	u.Retry = &p
+	return u
+}
+
+func (u *Updater) WithOnProgress(f func(Progress)) *Updater {
+	u.OnProgress = f
+	return u
+}
+
+// WithHTTPClient sends the updater's requests through c. The requester
+// already set keeps its other settings, c reaches the HTTP and OCI
+// requesters it wraps, ex: through a ThrottledRequester. A requester that
+// sends no HTTP requests of its own is left alone and the call is logged.
+func (u *Updater) WithHTTPClient(c *http.Client) *Updater {
+	if u.Requester == nil {
+		u.Requester = NewHTTPRequester().WithHTTPClient(c)
+		return u
+	}
+	if !useHTTPClient(u.Requester, c) {
+		u.logger().Log(zapcore.WarnLevel, "update: the requester takes no http client, WithHTTPClient ignored",
+			zapcore.Field{Key: "requester", Type: zapcore.StringType, String: fmt.Sprintf("%T", u.Requester)})
+	}
+	return u
+}
+
+// WithDefaultCache turns on an artifact cache in Dir holding at most
+// maxBytes, ex: DefaultCacheMaxBytes. It moves along with Dir.
+func (u *Updater) WithDefaultCache(maxBytes int64) *Updater {
+	u.Cache = NewArtifactCache(u.defaultCacheDir(), maxBytes)
+	return u
+}
+
+// WithCache replaces the artifact cache, nil disables caching.
+func (u *Updater) WithCache(c *ArtifactCache) *Updater {
+	u.Cache = c
+	return u
+}
+
+func (u *Updater) WithChunkConcurrency(n int) *Updater {
+	u.ChunkConcurrency = n
+	return u
+}
+
+// WithBundleDir sets the directory bundle updates replace as a whole.
+func (u *Updater) WithBundleDir(dir string) *Updater {
+	u.BundleDir = dir
+	return u
+}
+
+// WithDryRun makes the updater only report what offered updates would do,
+// to onReport if set.
+func (u *Updater) WithDryRun(onReport func(*DryRunReport)) *Updater {
+	u.DryRun = true
+	u.OnDryRun = onReport
+	return u
+}
+
+// WithExecutablePath updates the executable at path instead of the running
+// one.
+func (u *Updater) WithExecutablePath(path string) *Updater {
+	return u.rebase(func() { u.ExecutablePath = path })
+}
+
+// WithSlots installs updates to the A/B slots under dir, see SlotA.
+func (u *Updater) WithSlots(dir string) *Updater {
+	return u.rebase(func() { u.SlotsDir = dir })
+}
+
+// WithStateStore keeps the updater's and its trigger's state in s.
+func (u *Updater) WithStateStore(s StateStore) *Updater {
+	u.Store = s
+	return u
+}
+
+// WithLockMode sets what Update does while another updater of the
+// executable is installing.
+func (u *Updater) WithLockMode(m LockMode) *Updater {
+	u.LockMode = m
+	return u
+}
+
+// WithHistoryLimits sets when the history journal is rotated and how many
+// rotated journals are kept, see HistoryMaxBytes.
+func (u *Updater) WithHistoryLimits(maxBytes int64, maxFiles int) *Updater {
+	u.HistoryMaxBytes = maxBytes
+	u.HistoryMaxFiles = maxFiles
+	return u
+}
@@ -0,0 +1,199 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// DryRunReport tells what an update would have done.
+type DryRunReport struct {
+	Version        string        // offered version
+	CurrentVersion string        // running version
+	UpToDate       bool          // nothing would be installed
+	Target         string        // executable or bundle directory that would be replaced
+	Source         string        // where the update came from: "cache", "peer", "patch" or "full"
+	Bytes          int64         // bytes downloaded to get it
+	Checks         []DryRunCheck // in the order they ran
+}
+
+// DryRunCheck is the outcome of one step of the dry run.
+type DryRunCheck struct {
+	Name   string
+	Passed bool
+	Detail string // the error, or what was found
+}
+
+// OK reports whether every check passed.
+func (r *DryRunReport) OK() bool {
+	return r.Err() == nil
+}
+
+// Err returns the first failed check as an error.
+func (r *DryRunReport) Err() error {
+	for _, c := range r.Checks {
+		if !c.Passed {
+			return fmt.Errorf("dry run: %s: %s", c.Name, c.Detail)
+		}
+	}
+	return nil
+}
+
+func (r *DryRunReport) check(name string, err error, detail string) bool {
+	c := DryRunCheck{Name: name, Passed: err == nil, Detail: detail}
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+	return err == nil
+}
+
+// DryRunUpdate goes through the update offered in Info without replacing
+// anything: the preflight checks run, the update is fetched, patched and
+// verified, a bundle is extracted to a scratch directory and the attributes
+// of the executable are tried on a scratch file. Hooks are not run, nothing
+// is put in the cache and the mirror health is recorded to a scratch copy.
+func (u *Updater) DryRunUpdate() *DryRunReport {
+	ctx := u.dryRunContext(u.context())
+	r := &DryRunReport{Version: u.Info.Version, CurrentVersion: u.CurrentVersion}
+	if u.Info.Version == u.CurrentVersion {
+		r.UpToDate = true
+		return r
+	}
+	if !r.check("pins", u.checkPins(u.Info.Version), "no pin rules the version out") {
+		return r
+	}
+	if !r.check("can-update", u.canUpdate(), "the install directory is writable") {
+		return r
+	}
+	path, err := u.executable()
+	if !r.check("executable", err, path) {
+		return r
+	}
+	r.Target = path
+	if u.SlotsDir != "" {
+		r.Target, err = u.inactiveSlotDir()
+		if !r.check("slot", err, r.Target) {
+			return r
+		}
+	} else if u.Info.Bundle != nil {
+		if u.BundleDir == "" {
+			r.check("bundle-dir", ErrNoBundleDir, "")
+			return r
+		}
+		r.Target = u.bundleDir()
+		r.check("bundle-dir", nil, r.Target)
+	}
+
+	old, err := os.Open(path)
+	if !r.check("open-executable", err, path) {
+		return r
+	}
+	defer old.Close()
+	bin, err := u.fetchCounted(ctx, old, &r.Source, &r.Bytes)
+	old.Close()
+	if !r.check("fetch", err, fmt.Sprintf("%d bytes verified from %s, %d bytes downloaded", len(bin), r.Source, r.Bytes)) {
+		return r
+	}
+
+	if u.Info.Bundle != nil {
+		u.dryRunBundle(r, path, bin)
+	} else {
+		r.check("attributes", u.dryRunAttrs(path, filepath.Dir(r.Target)), "reproducible on the new executable")
+	}
+
+	var hooks []string
+	for _, phase := range []string{HookPreInstall, HookPostInstall, HookOnRollback} {
+		if h := u.hook(phase); h != nil && len(h.Command) > 0 {
+			hooks = append(hooks, phase+": "+strings.Join(h.Command, " "))
+		}
+	}
+	if len(hooks) > 0 {
+		r.check("hooks", nil, "not run in a dry run; "+strings.Join(hooks, "; "))
+	}
+	return r
+}
+
+// dryRunKey carries the mirror health a dry run records to in its context.
+type dryRunKey struct{}
+
+// dryRunContext marks ctx as a dry run. The mirrors are ordered by the
+// health recorded so far, what the run learns is thrown away with it.
+func (u *Updater) dryRunContext(ctx context.Context) context.Context {
+	scratch := NewMemoryStateStore()
+	if p, err := u.store().Get(StateKeyMirrors); err == nil {
+		_ = scratch.Put(StateKeyMirrors, p)
+	}
+	return context.WithValue(ctx, dryRunKey{}, &mirrorHealthStore{store: scratch, log: u.logger()})
+}
+
+// isDryRun reports whether ctx is that of a dry run, which writes nothing
+// that outlives it.
+func isDryRun(ctx context.Context) bool {
+	return ctx.Value(dryRunKey{}) != nil
+}
+
+// dryRunBundle extracts the bundle next to its target and throws it away.
+func (u *Updater) dryRunBundle(r *DryRunReport, exe string, archive []byte) {
+	scratch, err := os.MkdirTemp(filepath.Dir(r.Target), ".dryrun-")
+	if !r.check("extract", err, "") {
+		return
+	}
+	defer os.RemoveAll(scratch)
+	dir := filepath.Join(scratch, "bundle")
+	if !r.check("extract", extractBundle(archive, u.Info.Bundle.Format, dir), "extracted safely") {
+		return
+	}
+	if _, err := bundleMain(dir, u.Info.Bundle.Main); !r.check("bundle-main", err, u.Info.Bundle.Main) {
+		return
+	}
+	oldMain := filepath.Join(r.Target, filepath.FromSlash(u.Info.Bundle.Main))
+	if u.SlotsDir != "" {
+		// the target is the inactive slot, the attributes come from the active one
+		oldMain = exe
+	}
+	if _, err := os.Stat(oldMain); err == nil {
+		r.check("attributes", u.dryRunAttrs(oldMain, scratch), "reproducible on the new executable")
+	}
+}
+
+// dryRunAttrs tries the attributes of src on a scratch file in dir.
+func (u *Updater) dryRunAttrs(src, dir string) error {
+	fp, err := os.CreateTemp(dir, ".dryrun-")
+	if err != nil {
+		return err
+	}
+	fp.Close()
+	defer os.Remove(fp.Name())
+	errs := copyFileAttrs(src, fp.Name(), u.Info.FileAttrs)
+	if u.AttrBestEffort {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// dryRun reports the offered update to OnDryRun, or logs it.
+func (u *Updater) dryRun() {
+	r := u.DryRunUpdate()
+	if u.OnDryRun != nil {
+		u.OnDryRun(r)
+		return
+	}
+	fields := []zapcore.Field{
+		{Key: "version", Type: zapcore.StringType, String: r.Version},
+		{Key: "target", Type: zapcore.StringType, String: r.Target},
+		{Key: "source", Type: zapcore.StringType, String: r.Source},
+		{Key: "bytes", Type: zapcore.Int64Type, Integer: r.Bytes},
+	}
+	if err := r.Err(); err != nil {
+		u.logger().Log(zapcore.WarnLevel, "update: dry run failed",
+			append(fields, zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})...)
+		return
+	}
+	u.logger().Log(zapcore.InfoLevel, "update: dry run passed", fields...)
+}
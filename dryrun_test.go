@@ -0,0 +1,101 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// offerOnce offers info on the first check and nothing after.
+type offerOnce struct {
+	info UpdatePackageInfo
+	sent bool
+}
+
+func (o *offerOnce) Trigger(ctx context.Context) chan UpdatePackageInfo {
+	ch := make(chan UpdatePackageInfo, 1)
+	if !o.sent {
+		o.sent = true
+		ch <- o.info
+	}
+	return ch
+}
+
+func TestDryRunLeavesNoTrace(t *testing.T) {
+	old, new := patchPair()
+	patch, err := DiffPatch(PatchZstdFrom, old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHash, newHash := sha256.Sum256(old), sha256.Sum256(new)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/up/agent", func(w http.ResponseWriter, r *http.Request) { w.Write(new) })
+	mux.HandleFunc("/up/agent."+hex.EncodeToString(oldHash[:])+".patch", func(w http.ResponseWriter, r *http.Request) { w.Write(patch) })
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "agent")
+	newPath, oldPath := stagingPaths(exe)
+	for p, body := range map[string][]byte{exe: old, newPath: new, oldPath: old} {
+		if err := os.WriteFile(p, body, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := NewMemoryStateStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var report *DryRunReport
+	u := &Updater{
+		ctx:            ctx,
+		ExecutablePath: exe,
+		Dir:            "state",
+		Logger:         nopLog{},
+		Store:          store,
+		Cache:          NewArtifactCache(filepath.Join(dir, "cache"), 0),
+		Retry:          &RetryPolicy{MaxAttempts: 2},
+		DryRun:         true,
+		OnDryRun: func(r *DryRunReport) {
+			report = r
+			cancel()
+		},
+		Trigger: &offerOnce{info: UpdatePackageInfo{
+			Version:     "2.0.0",
+			DownloadUrl: ts.URL + "/down/agent",
+			Mirrors:     []Mirror{{Url: ts.URL + "/up/agent"}},
+			ContentHash: newHash[:],
+			Compression: CompressionNone,
+			IsPatch:     true,
+		}},
+	}
+	if err := u.BackgroundRun(); err != nil {
+		t.Fatal(err)
+	}
+	if report == nil {
+		t.Fatal("no dry run report")
+	}
+	if err := report.Err(); err != nil || report.Source != sourcePatch {
+		t.Fatalf("dry run: %v from %q, want a patch", err, report.Source)
+	}
+
+	for _, p := range []string{newPath, oldPath} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("dry run recovered %s: %v", filepath.Base(p), err)
+		}
+	}
+	if _, err := store.Get(StateKeyMirrors); !errors.Is(err, ErrStateNotFound) {
+		t.Errorf("dry run recorded mirror health: %v", err)
+	}
+	if _, err := u.Cache.Get(newHash[:]); err == nil {
+		t.Error("dry run cached the binary")
+	}
+	if _, err := u.Cache.GetPatch(oldHash[:], newHash[:]); err == nil {
+		t.Error("dry run cached the patch")
+	}
+}
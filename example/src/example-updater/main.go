@@ -28,7 +28,6 @@ func main() {
 		opamppackagemgm.NewLog(),
 	))
 	up.WithLogger(opamppackagemgm.NewLog())
-	up.WithIsGzipped(true)
 	onSuccess := func(ctx context.Context) {
 		log.Printf("(example-updater) Successfully updated to version: %q", version)
 	}
@@ -0,0 +1,121 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileRequester reads artifacts from the local filesystem, so a mounted
+// share or a USB stick can act as the update repository. It accepts
+// file:// urls as well as plain paths; relative paths are resolved
+// against Root.
+type FileRequester struct {
+	Root string
+}
+
+func NewFileRequester(root string) *FileRequester {
+	return &FileRequester{Root: root}
+}
+
+// Fetch opens the file the url points to.
+func (f *FileRequester) Fetch(url string) (io.ReadCloser, error) {
+	return f.FetchContext(context.Background(), url)
+}
+
+// FetchContext is Fetch bound to ctx, cancelling ctx closes the file.
+func (f *FileRequester) FetchContext(ctx context.Context, url string) (io.ReadCloser, error) {
+	fp, err := f.open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return newCtxReadCloser(ctx, fp), nil
+}
+
+func (f *FileRequester) open(ctx context.Context, url string) (*fileReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path, err := f.resolve(url)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		fp.Close()
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	return &fileReadCloser{File: fp, size: fi.Size()}, nil
+}
+
+// FetchRange returns length bytes of the file starting at offset.
+func (f *FileRequester) FetchRange(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error) {
+	fp, err := f.open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset+length > fp.size {
+		fp.Close()
+		return nil, fmt.Errorf("range %d-%d is beyond the %d bytes of %s", offset, offset+length-1, fp.size, url)
+	}
+	return newCtxReadCloser(ctx, &sectionReadCloser{
+		SectionReader: io.NewSectionReader(fp, offset, length),
+		Closer:        fp,
+	}), nil
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// SetHeader is a no-op, files have no headers.
+func (f *FileRequester) SetHeader(header map[string]string) {}
+
+func (f *FileRequester) resolve(rawURL string) (string, error) {
+	path := rawURL
+	if strings.HasPrefix(rawURL, "file:") {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return "", err
+		}
+		if u.Host != "" && u.Host != "localhost" {
+			return "", fmt.Errorf("file url with remote host %q is not supported", u.Host)
+		}
+		path = u.Path
+		if u.Opaque != "" {
+			// file:relative/path
+			path = u.Opaque
+		}
+		// file:///C:/dir -> C:/dir
+		if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+			path = path[1:]
+		}
+	}
+	path = filepath.FromSlash(path)
+	if !filepath.IsAbs(path) && f.Root != "" {
+		path = filepath.Join(f.Root, path)
+	}
+	return path, nil
+}
+
+type fileReadCloser struct {
+	*os.File
+	size int64
+}
+
+func (f *fileReadCloser) Size() int64 {
+	return f.size
+}
@@ -3,8 +3,20 @@ module github.com/ploynomail/opamp-package-mgm
 go 1.22.5
 
 require (
+	github.com/hashicorp/mdns v1.0.6
+	github.com/klauspost/compress v1.18.0
 	github.com/kr/binarydist v0.1.0
+	github.com/ulikunitz/xz v0.5.17
+	go.etcd.io/bbolt v1.3.11
 	go.uber.org/zap v1.27.0
+	golang.org/x/mod v0.23.0
+	golang.org/x/sys v0.30.0
 )
 
-require go.uber.org/multierr v1.10.0 // indirect
+require (
+	github.com/miekg/dns v1.1.65 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/net v0.35.0 // indirect
+	golang.org/x/sync v0.11.0 // indirect
+	golang.org/x/tools v0.30.0 // indirect
+)
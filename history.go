@@ -0,0 +1,185 @@
+package opamppackagemgm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const historyPath = "history.jsonl"
+
+const (
+	// DefaultHistoryMaxBytes is the size at which the journal is rotated.
+	DefaultHistoryMaxBytes = 1 << 20
+	// DefaultHistoryMaxFiles is how many rotated journals are kept.
+	DefaultHistoryMaxFiles = 3
+)
+
+// Outcomes of an update attempt.
+const (
+	OutcomeSucceeded  = "succeeded"
+	OutcomeFailed     = "failed"      // nothing was replaced, or the install was undone on the spot
+	OutcomeRolledBack = "rolled-back" // installed, then put back after the post-install hook failed
+	OutcomeBlocked    = "blocked"     // offered, but a pin ruled it out, see Pin
+)
+
+// HistoryEntry is one update attempt in the journal.
+type HistoryEntry struct {
+	Time     time.Time     `json:"time"` // when the attempt started
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Source   string        `json:"source,omitempty"` // "cache", "peer", "patch" or "full", empty if nothing was fetched
+	Bytes    int64         `json:"bytes"`            // bytes downloaded
+	Duration time.Duration `json:"duration"`
+	Outcome  string        `json:"outcome"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// History returns the update attempts recorded in Dir, oldest first,
+// including the rotated journals that are still kept. A line torn by a
+// power cut is skipped.
+func (u *Updater) History() ([]HistoryEntry, error) {
+	u.historyMu.Lock()
+	defer u.historyMu.Unlock()
+	path := u.historyFile()
+	var entries []HistoryEntry
+	for i := u.historyMaxFiles(); i >= 0; i-- {
+		name := path
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", path, i)
+		}
+		fp, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(fp)
+		for scanner.Scan() {
+			var e HistoryEntry
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				entries = append(entries, e)
+			}
+		}
+		err = scanner.Err()
+		fp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// record appends e to the journal. Failing to write it is only logged, it
+// never fails the update.
+func (u *Updater) record(e HistoryEntry) {
+	fields := []zapcore.Field{
+		{Key: "from", Type: zapcore.StringType, String: e.From},
+		{Key: "to", Type: zapcore.StringType, String: e.To},
+		{Key: "source", Type: zapcore.StringType, String: e.Source},
+		{Key: "bytes", Type: zapcore.Int64Type, Integer: e.Bytes},
+		{Key: "duration", Type: zapcore.DurationType, Integer: int64(e.Duration)},
+		{Key: "outcome", Type: zapcore.StringType, String: e.Outcome},
+	}
+	level := zapcore.InfoLevel
+	if e.Error != "" {
+		level = zapcore.ErrorLevel
+		fields = append(fields, zapcore.Field{Key: "error", Type: zapcore.StringType, String: e.Error})
+	}
+	u.logger().Log(level, "update: finished", fields...)
+
+	if u.HistoryMaxBytes < 0 {
+		return
+	}
+	if err := u.appendHistory(e); err != nil {
+		u.logger().Log(zapcore.WarnLevel, "update: writing the history journal failed",
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	}
+}
+
+func (u *Updater) appendHistory(e HistoryEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	u.historyMu.Lock()
+	defer u.historyMu.Unlock()
+	path := u.historyFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > u.historyMaxBytes() {
+		if err := u.rotateHistory(path); err != nil {
+			return err
+		}
+	}
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// start on a line of our own after a write torn by a power cut
+	last := make([]byte, 1)
+	if fi, err := fp.Stat(); err == nil && fi.Size() > 0 {
+		if _, err := fp.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := fp.Write(line); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// rotateHistory shifts path to path.1, path.1 to path.2 and so on, dropping
+// the journal past historyMaxFiles.
+func (u *Updater) rotateHistory(path string) error {
+	keep := u.historyMaxFiles()
+	if keep == 0 {
+		return os.Remove(path)
+	}
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, keep)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := keep - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
+
+func (u *Updater) historyFile() string {
+	return filepath.Join(u.getExecRelativeDir(u.Dir), historyPath)
+}
+
+func (u *Updater) historyMaxBytes() int64 {
+	if u.HistoryMaxBytes == 0 {
+		return DefaultHistoryMaxBytes
+	}
+	return u.HistoryMaxBytes
+}
+
+func (u *Updater) historyMaxFiles() int {
+	if u.HistoryMaxFiles == 0 {
+		return DefaultHistoryMaxFiles
+	}
+	if u.HistoryMaxFiles < 0 {
+		return 0
+	}
+	return u.HistoryMaxFiles
+}
@@ -0,0 +1,219 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Hook phases, also passed to the hook as OPAMP_HOOK.
+const (
+	HookPreInstall  = "pre-install"
+	HookPostInstall = "post-install"
+	HookOnRollback  = "on-rollback"
+)
+
+const (
+	// DefaultHookTimeout bounds a hook that sets no timeout of its own.
+	DefaultHookTimeout = 5 * time.Minute
+	// hookOutputLimit is how much of a hook's output is kept, the tail wins.
+	hookOutputLimit = 64 << 10
+)
+
+// Hooks are commands the manifest asks to run around the install, ex: a
+// schema migration only the new version knows how to do.
+//
+// A failing pre-install hook aborts the update before anything is
+// replaced. A failing post-install hook rolls the install back, after
+// which the on-rollback hook runs.
+type Hooks struct {
+	PreInstall  *Hook `json:"pre_install,omitempty"`
+	PostInstall *Hook `json:"post_install,omitempty"`
+	OnRollback  *Hook `json:"on_rollback,omitempty"`
+}
+
+// Hook is one command. It runs in the bundle directory for bundles (the
+// staged one before the swap, the rejected one after a rollback) and next to
+// the executable otherwise; a relative path containing a separator, ex:
+// "hooks/migrate.sh", is taken from there. Besides Env it gets
+// OPAMP_HOOK, OPAMP_OLD_VERSION, OPAMP_NEW_VERSION, OPAMP_EXECUTABLE and,
+// for bundles, OPAMP_BUNDLE_DIR.
+type Hook struct {
+	Command []string          `json:"command"`           // argv, ex: ["bin/agent", "migrate"]
+	Timeout int               `json:"timeout,omitempty"` // seconds, defaults to DefaultHookTimeout
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// HookError reports a hook that failed, timed out or couldn't be started.
+type HookError struct {
+	Phase    string
+	ExitCode int    // -1 if the hook didn't exit on its own
+	Output   string // tail of stdout and stderr
+	Err      error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook failed (exit code %d): %v", e.Phase, e.ExitCode, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// hook returns the manifest's hook for phase, or nil.
+func (u *Updater) hook(phase string) *Hook {
+	h := u.Info.Hooks
+	if h == nil {
+		return nil
+	}
+	switch phase {
+	case HookPreInstall:
+		return h.PreInstall
+	case HookPostInstall:
+		return h.PostInstall
+	case HookOnRollback:
+		return h.OnRollback
+	}
+	return nil
+}
+
+// runHook runs the hook for phase, if the manifest has one, in dir. Its
+// output is logged and, on failure, returned in a *HookError.
+func (u *Updater) runHook(ctx context.Context, phase, dir, exe string) error {
+	hook := u.hook(phase)
+	if hook == nil || len(hook.Command) == 0 {
+		return nil
+	}
+	timeout := DefaultHookTimeout
+	if hook.Timeout > 0 {
+		timeout = time.Duration(hook.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	name := hook.Command[0]
+	if !filepath.IsAbs(name) && strings.ContainsAny(name, `/\`) {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+	}
+	cmd := exec.CommandContext(ctx, name, hook.Command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"OPAMP_HOOK="+phase,
+		"OPAMP_OLD_VERSION="+u.oldVersion(),
+		"OPAMP_NEW_VERSION="+u.Info.Version,
+		"OPAMP_EXECUTABLE="+exe,
+	)
+	if u.Info.Bundle != nil {
+		cmd.Env = append(cmd.Env, "OPAMP_BUNDLE_DIR="+dir)
+	}
+	for k, v := range hook.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	out := &tailBuffer{limit: hookOutputLimit}
+	cmd.Stdout, cmd.Stderr = out, out
+	// don't wait forever on children that inherited the output pipes
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %v: %w", timeout, err)
+	}
+	fields := []zapcore.Field{
+		{Key: "hook", Type: zapcore.StringType, String: phase},
+		{Key: "duration", Type: zapcore.DurationType, Integer: int64(time.Since(start))},
+		{Key: "output", Type: zapcore.StringType, String: out.String()},
+	}
+	if err == nil {
+		u.logger().Log(zapcore.InfoLevel, "update: hook succeeded", fields...)
+		return nil
+	}
+	u.logger().Log(zapcore.ErrorLevel, "update: hook failed",
+		append(fields, zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})...)
+	hookErr := &HookError{Phase: phase, ExitCode: -1, Output: out.String(), Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Exited() {
+		hookErr.ExitCode = exitErr.ExitCode()
+	}
+	return hookErr
+}
+
+// postInstall runs the post-install hook and, if it passes, drops the
+// previous version kept next to target. Otherwise the install is rolled
+// back and the on-rollback hook runs against the rejected update. Slot
+// installs keep the previous slot either way.
+func (u *Updater) postInstall(ctx context.Context, exe, target string) error {
+	if u.SlotsDir != "" {
+		return u.postInstallSlot(ctx, exe, target)
+	}
+	dir := filepath.Dir(exe)
+	if u.Info.Bundle != nil {
+		dir = target
+	}
+	err := u.runHook(ctx, HookPostInstall, dir, exe)
+	if err == nil {
+		if err := finishInstall(target); err != nil {
+			u.logger().Log(zapcore.WarnLevel, "update: removing the previous version failed",
+				zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		}
+		return nil
+	}
+	if rbErr := rollbackInstall(target); rbErr != nil {
+		return fmt.Errorf("%w; rolling back failed: %v", err, rbErr)
+	}
+	rejected, _ := stagingPaths(target)
+	if u.Info.Bundle != nil {
+		dir = rejected
+	}
+	// already logged, the post-install failure is what gets reported
+	_ = u.runHook(ctx, HookOnRollback, dir, exe)
+	_ = os.RemoveAll(rejected)
+	if u.OnFailedUpdate != nil {
+		u.OnFailedUpdate(ctx)
+	}
+	return err
+}
+
+// postInstallSlot is postInstall for the slot at dir, which current
+// already points at. A failure switches current back, or removes it after
+// a first slot install that has nothing to go back to.
+func (u *Updater) postInstallSlot(ctx context.Context, exe, dir string) error {
+	err := u.runHook(ctx, HookPostInstall, dir, exe)
+	if err == nil {
+		return nil
+	}
+	if rbErr := u.revertSlot(filepath.Base(dir)); rbErr != nil {
+		return fmt.Errorf("%w; rolling back failed: %v", err, rbErr)
+	}
+	// the rejected slot is left in place until the next update
+	_ = u.runHook(ctx, HookOnRollback, dir, exe)
+	if u.OnFailedUpdate != nil {
+		u.OnFailedUpdate(ctx)
+	}
+	return err
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.limit {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.limit:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
@@ -0,0 +1,123 @@
+//go:build linux
+
+package opamppackagemgm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// installBinary replaces the executable at updatePath so that, whatever
+// moment power is lost, the path holds either the complete old or the
+// complete new binary:
+//
+//  1. the new binary is written to .name.new, handed to prepare (which
+//     copies the old file's attributes) and fsynced,
+//  2. it is swapped with the executable by renameat2(RENAME_EXCHANGE), or,
+//     where the filesystem lacks it, the executable is hard linked to
+//     .name.old and .name.new is renamed over it,
+//  3. the directory is fsynced so the swap itself is durable.
+//
+// The previous binary stays at .name.old until finishInstall or
+// rollbackInstall; leftovers of an interrupted install are handled by
+// recoverInstall.
+func installBinary(updatePath string, newBytes []byte, prepare func(newPath string) error) (err error, errRecover error) {
+	newPath, oldPath := stagingPaths(updatePath)
+	dir := filepath.Dir(updatePath)
+
+	if err = writeSynced(newPath, newBytes, 0755, prepare); err != nil {
+		_ = os.Remove(newPath)
+		return
+	}
+	if err = syncDir(dir); err != nil {
+		_ = os.Remove(newPath)
+		return
+	}
+	_ = os.Remove(oldPath)
+
+	err = unix.Renameat2(unix.AT_FDCWD, newPath, unix.AT_FDCWD, updatePath, unix.RENAME_EXCHANGE)
+	switch {
+	case err == nil:
+		// .name.new now holds the previous binary, the update itself is done
+		if err = os.Rename(newPath, oldPath); err != nil {
+			err, errRecover = unswap(newPath, updatePath, err)
+			return
+		}
+	case errors.Is(err, unix.ENOSYS), errors.Is(err, unix.EINVAL), errors.Is(err, unix.EOPNOTSUPP):
+		if err = os.Link(updatePath, oldPath); err != nil {
+			_ = os.Remove(newPath)
+			return
+		}
+		// rename replaces the target atomically, the link keeps the
+		// previous binary around until the swap is durable
+		err = os.Rename(newPath, updatePath)
+	default:
+		_ = os.Remove(newPath)
+		return
+	}
+	if err != nil {
+		_ = os.Remove(newPath)
+		return
+	}
+	err = syncDir(dir)
+	return
+}
+
+// unswap undoes a RENAME_EXCHANGE of newPath and path after the previous
+// version, left at newPath, couldn't be moved to .name.old, so the update
+// fails with the previous version in place. If even that fails newPath is
+// kept, it is the only copy of the previous version.
+func unswap(newPath, path string, err error) (error, error) {
+	if errRecover := unix.Renameat2(unix.AT_FDCWD, newPath, unix.AT_FDCWD, path, unix.RENAME_EXCHANGE); errRecover != nil {
+		return err, fmt.Errorf("the previous version is left at %s: %w", newPath, errRecover)
+	}
+	_ = os.RemoveAll(newPath)
+	return err, nil
+}
+
+// syncDir fsyncs a directory so renames inside it survive a power cut.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// installDir swaps the extracted bundle newDir in for dir with
+// renameat2(RENAME_EXCHANGE), so the directory is never missing. Where the
+// filesystem lacks it dir is briefly moved aside, see swapDirs. The
+// previous bundle is kept at .name.old like the previous binary.
+func installDir(dir, newDir string) (err error, errRecover error) {
+	_, oldDir := stagingPaths(dir)
+	parent := filepath.Dir(dir)
+	if err = syncDir(parent); err != nil {
+		_ = os.RemoveAll(newDir)
+		return
+	}
+	_ = os.RemoveAll(oldDir)
+
+	err = unix.Renameat2(unix.AT_FDCWD, newDir, unix.AT_FDCWD, dir, unix.RENAME_EXCHANGE)
+	switch {
+	case err == nil:
+		// .name.new now holds the previous bundle
+		if err = os.Rename(newDir, oldDir); err != nil {
+			err, errRecover = unswap(newDir, dir, err)
+			return
+		}
+	case errors.Is(err, unix.ENOENT), errors.Is(err, unix.ENOSYS), errors.Is(err, unix.EINVAL), errors.Is(err, unix.EOPNOTSUPP):
+		if err, errRecover = swapDirs(dir, newDir, oldDir); err != nil {
+			return
+		}
+	default:
+		_ = os.RemoveAll(newDir)
+		return
+	}
+	err = syncDir(parent)
+	return
+}
@@ -0,0 +1,73 @@
+//go:build !linux
+
+package opamppackagemgm
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// installBinary writes newBytes to .name.new, hands it to prepare and
+// swaps it in for the executable at updatePath, restoring the previous
+// binary on failure. On success the previous binary stays at .name.old
+// until finishInstall or rollbackInstall.
+func installBinary(updatePath string, newBytes []byte, prepare func(newPath string) error) (err error, errRecover error) {
+	newPath, oldPath := stagingPaths(updatePath)
+
+	// Copy the contents of of newbinary to a the new executable file
+	fp, err := os.OpenFile(newPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	_, err = io.Copy(fp, bytes.NewReader(newBytes))
+	if err == nil && prepare != nil {
+		err = prepare(newPath)
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+
+	// if we don't call fp.Close(), windows won't let us move the new executable
+	// because the file will still be "in use"
+	fp.Close()
+	if err != nil {
+		_ = os.Remove(newPath)
+		return
+	}
+
+	// delete any existing old exec file - this is necessary on Windows for two reasons:
+	// 1. after a successful update, Windows can't remove the .old file because the process is still running
+	// 2. windows rename operations fail if the destination file already exists
+	_ = os.Remove(oldPath)
+
+	// move the existing executable to a new file in the same directory
+	err = os.Rename(updatePath, oldPath)
+	if err != nil {
+		return
+	}
+
+	// move the new exectuable in to become the new program
+	err = os.Rename(newPath, updatePath)
+
+	if err != nil {
+		// copy unsuccessful
+		errRecover = os.Rename(oldPath, updatePath)
+	}
+
+	return
+}
+
+// installDir swaps the extracted bundle newDir in for dir. On windows this
+// fails while a file inside dir is still open.
+func installDir(dir, newDir string) (err error, errRecover error) {
+	_, oldDir := stagingPaths(dir)
+	_ = os.RemoveAll(oldDir)
+	return swapDirs(dir, newDir, oldDir)
+}
+
+// syncDir is a no-op, directories can't be synced portably.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build solaris || aix
+
+package opamppackagemgm
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an fcntl lock on the whole of f, flock is missing here.
+// With nonblock set it returns errLockHeld instead of waiting for another
+// holder.
+//
+// fcntl locks belong to the process, not the descriptor: they don't keep
+// two holders in one process apart and closing any descriptor of the file
+// drops them.
+func lockFile(f *os.File, exclusive, nonblock bool) error {
+	lk := unix.Flock_t{Type: unix.F_RDLCK, Whence: 0}
+	if exclusive {
+		lk.Type = unix.F_WRLCK
+	}
+	cmd := unix.F_SETLKW
+	if nonblock {
+		cmd = unix.F_SETLK
+	}
+	for {
+		err := unix.FcntlFlock(f.Fd(), cmd, &lk)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES) {
+			return errLockHeld
+		}
+		return err
+	}
+}
+
+func unlockFile(f *os.File) error {
+	lk := unix.Flock_t{Type: unix.F_UNLCK, Whence: 0}
+	return unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lk)
+}
@@ -0,0 +1,36 @@
+//go:build unix && !solaris && !aix
+
+package opamppackagemgm
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an advisory flock on f. With nonblock set it returns
+// errLockHeld instead of waiting for another holder.
+func lockFile(f *os.File, exclusive, nonblock bool) error {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if nonblock {
+		how |= unix.LOCK_NB
+	}
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return errLockHeld
+		}
+		return err
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
@@ -0,0 +1,19 @@
+//go:build !unix && !windows
+
+package opamppackagemgm
+
+import "os"
+
+// lockFile is a no-op where the platform offers no advisory locks.
+func lockFile(f *os.File, exclusive, nonblock bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
+
+// processAlive can't tell, every holder is taken to be alive.
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,543 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// OCI media types understood when resolving a tag.
+const (
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+
+	annotationTitle   = "org.opencontainers.image.title"
+	annotationVersion = "org.opencontainers.image.version"
+	// AnnotationContentDigest is the layer annotation carrying the digest of
+	// the binary, ex: "sha256:<hex>", when the layer itself is compressed.
+	AnnotationContentDigest = "org.opamp.package.content.digest"
+	// AnnotationFileAttrs is the layer annotation carrying the FileAttrs
+	// policy of the binary as JSON, ex: {"mode":2541}.
+	AnnotationFileAttrs = "org.opamp.package.file-attrs"
+)
+
+var manifestAccept = strings.Join([]string{
+	mediaTypeOCIIndex,
+	mediaTypeOCIManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeDockerManifest,
+}, ", ")
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest covers both an image index and an image manifest, the
+// populated fields tell them apart.
+type ociManifest struct {
+	MediaType   string            `json:"mediaType"`
+	Manifests   []ociDescriptor   `json:"manifests,omitempty"`
+	Layers      []ociDescriptor   `json:"layers,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (m *ociManifest) isIndex() bool {
+	return m.MediaType == mediaTypeOCIIndex ||
+		m.MediaType == mediaTypeDockerManifestList ||
+		(m.MediaType == "" && len(m.Manifests) > 0)
+}
+
+// OCIRequester fetches manifests and blobs from an OCI distribution
+// registry. Requests are anonymous unless Token or Username/Password is set;
+// in both cases the registry's bearer token challenge is honoured.
+type OCIRequester struct {
+	Token    string // static bearer token sent with every request
+	Username string // optional credentials used for the token exchange
+	Password string
+	Header   map[string]string
+	Client   *http.Client // optional, defaults to a client with the default connect and header timeouts
+
+	mu     sync.Mutex
+	tokens map[string]string // challenge scope -> token
+}
+
+func NewOCIRequester() *OCIRequester {
+	return &OCIRequester{}
+}
+
+// Fetch returns the body of a registry resource, typically a blob URL of
+// the form <registry>/v2/<repository>/blobs/<digest>.
+func (o *OCIRequester) Fetch(url string) (io.ReadCloser, error) {
+	return o.FetchContext(context.Background(), url)
+}
+
+// FetchContext is Fetch bound to ctx. A body that stalls for
+// DefaultIdleTimeout is aborted.
+func (o *OCIRequester) FetchContext(ctx context.Context, url string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := o.get(ctx, url, "")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return newIdleTimeoutReader(resp.Body, resp.ContentLength, DefaultIdleTimeout, cancel), nil
+}
+
+func (o *OCIRequester) SetHeader(header map[string]string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.Header == nil {
+		o.Header = make(map[string]string)
+	}
+	for key, value := range header {
+		o.Header[key] = value
+	}
+}
+
+func (o *OCIRequester) httpClient() *http.Client {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.Client == nil {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.DialContext = (&net.Dialer{Timeout: DefaultConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+		tr.TLSHandshakeTimeout = DefaultConnectTimeout
+		tr.ResponseHeaderTimeout = DefaultHeaderTimeout
+		o.Client = &http.Client{Transport: tr}
+	}
+	return o.Client
+}
+
+func (o *OCIRequester) useHTTPClient(c *http.Client) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.Client = c
+	return true
+}
+
+func (o *OCIRequester) newRequest(ctx context.Context, rawURL, accept, token string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	for key, value := range o.Header {
+		req.Header.Set(key, value)
+	}
+	o.mu.Unlock()
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// get performs a GET and answers a single bearer challenge if the registry
+// asks for one.
+func (o *OCIRequester) get(ctx context.Context, rawURL, accept string) (*http.Response, error) {
+	client := o.httpClient()
+	token := o.Token
+	if token == "" {
+		token = o.cachedToken(rawURL)
+	}
+	req, err := o.newRequest(ctx, rawURL, accept, token)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && o.Token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		token, err = o.exchangeToken(ctx, challenge)
+		if err != nil {
+			return nil, err
+		}
+		o.storeToken(rawURL, token)
+		req, err = o.newRequest(ctx, rawURL, accept, token)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, &StatusError{URL: rawURL, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// tokenKey groups cached tokens per registry and repository, which is the
+// granularity registries scope pull tokens at.
+func tokenKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	path := u.Path
+	for _, sep := range []string{"/manifests/", "/blobs/"} {
+		if i := strings.Index(path, sep); i >= 0 {
+			path = path[:i]
+			break
+		}
+	}
+	return u.Host + path
+}
+
+func (o *OCIRequester) cachedToken(rawURL string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.tokens[tokenKey(rawURL)]
+}
+
+func (o *OCIRequester) storeToken(rawURL, token string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.tokens == nil {
+		o.tokens = make(map[string]string)
+	}
+	o.tokens[tokenKey(rawURL)] = token
+}
+
+// exchangeToken answers a `Bearer realm="...",service="...",scope="..."`
+// challenge by requesting a token from the realm.
+func (o *OCIRequester) exchangeToken(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") || params["realm"] == "" {
+		return "", fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", err
+	}
+	q := realm.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		q.Set("scope", params["scope"])
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if o.Username != "" {
+		req.SetBasicAuth(o.Username, o.Password)
+	}
+	resp, err := o.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("bad http status from %s: %v", realm.Host, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.New("registry returned an empty token")
+}
+
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	for rest != "" {
+		var pair string
+		rest = strings.TrimLeft(rest, ", ")
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				break
+			}
+			pair, rest = value[1:end+1], value[end+2:]
+		} else {
+			pair, rest, _ = strings.Cut(value, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = pair
+	}
+	return scheme, params
+}
+
+func (o *OCIRequester) fetchManifest(ctx context.Context, registry, repository, reference string) (*ociManifest, error) {
+	rawURL := fmt.Sprintf("%s/v2/%s/manifests/%s", strings.TrimRight(registry, "/"), repository, reference)
+	resp, err := o.get(ctx, rawURL, manifestAccept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var m ociManifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+	return &m, nil
+}
+
+// Resolve turns repository:tag into the update for the running platform.
+// An index is narrowed to the manifest matching runtime.GOOS/GOARCH and the
+// layer titled cmdName (or the only layer) becomes the artifact. The layer
+// is the binary itself, possibly compressed, not a tar archive, and the
+// index or manifest has to carry the version annotation.
+//
+// The content hash is that of the binary: the layer's
+// AnnotationContentDigest, or for an uncompressed layer its digest. A
+// compressed layer without the annotation is an error, its digest hashes
+// the compressed blob.
+// AnnotationFileAttrs on the layer becomes Info.FileAttrs.
+func (o *OCIRequester) Resolve(ctx context.Context, registry, repository, tag, cmdName string) (*UpdatePackageInfo, error) {
+	m, err := o.fetchManifest(ctx, registry, repository, tag)
+	if err != nil {
+		return nil, err
+	}
+	version := ""
+	if m.isIndex() {
+		version = m.Annotations[annotationVersion]
+		var desc *ociDescriptor
+		for i := range m.Manifests {
+			p := m.Manifests[i].Platform
+			if p != nil && p.OS == runtime.GOOS && p.Architecture == runtime.GOARCH {
+				desc = &m.Manifests[i]
+				break
+			}
+		}
+		if desc == nil {
+			return nil, fmt.Errorf("no manifest for platform %s in %s:%s", plat, repository, tag)
+		}
+		if m, err = o.fetchManifest(ctx, registry, repository, desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+	if v := m.Annotations[annotationVersion]; v != "" {
+		version = v
+	}
+	if version == "" {
+		// a floating tag can't stand in, it never equals the running version
+		return nil, fmt.Errorf("%s:%s has no %s annotation", repository, tag, annotationVersion)
+	}
+
+	layer, err := pickLayer(m.Layers, cmdName)
+	if err != nil {
+		return nil, err
+	}
+	if isTarLayer(layer.MediaType) {
+		return nil, fmt.Errorf("layer %s is a tar archive (%s), push the binary itself, ex: as application/octet-stream", layer.Digest, layer.MediaType)
+	}
+	compression := layerCompression(layer.MediaType)
+	digest := layer.Annotations[AnnotationContentDigest]
+	if digest == "" {
+		if compression != CompressionNone {
+			return nil, fmt.Errorf("layer %s is %s compressed and has no %s annotation", layer.Digest, compression, AnnotationContentDigest)
+		}
+		digest = layer.Digest
+	}
+	hash, err := parseDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	var attrs *FileAttrs
+	if p := layer.Annotations[AnnotationFileAttrs]; p != "" {
+		attrs = &FileAttrs{}
+		if err := json.Unmarshal([]byte(p), attrs); err != nil {
+			return nil, fmt.Errorf("layer %s: bad %s annotation: %w", layer.Digest, AnnotationFileAttrs, err)
+		}
+	}
+	return &UpdatePackageInfo{
+		Version:     version,
+		ContentHash: hash,
+		Compression: compression,
+		FileAttrs:   attrs,
+		DownloadUrl: fmt.Sprintf("%s/v2/%s/blobs/%s", strings.TrimRight(registry, "/"), repository, layer.Digest),
+	}, nil
+}
+
+// layerCompression tells the compression of a layer from its media type,
+// ex: application/vnd.opamp.package.binary.v1+gzip.
+func layerCompression(mediaType string) string {
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip"), strings.HasSuffix(mediaType, ".gzip"):
+		return CompressionGzip
+	case strings.HasSuffix(mediaType, "+zstd"), strings.HasSuffix(mediaType, ".zstd"):
+		return CompressionZstd
+	case strings.HasSuffix(mediaType, "+xz"), strings.HasSuffix(mediaType, ".xz"):
+		return CompressionXz
+	}
+	return CompressionNone
+}
+
+// isTarLayer tells image layers, ex: application/vnd.oci.image.layer.v1.tar+gzip
+// or application/vnd.docker.image.rootfs.diff.tar.gzip, apart.
+func isTarLayer(mediaType string) bool {
+	base, _, _ := strings.Cut(mediaType, "+")
+	return strings.HasSuffix(base, ".tar") || strings.Contains(base, ".tar.")
+}
+
+func parseDigest(digest string) ([]byte, error) {
+	algo, encoded, ok := strings.Cut(digest, ":")
+	if !ok || algo != "sha256" {
+		return nil, fmt.Errorf("unsupported digest %q", digest)
+	}
+	hash, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("bad digest %q: %w", digest, err)
+	}
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("bad digest %q: %d bytes, want %d", digest, len(hash), sha256.Size)
+	}
+	return hash, nil
+}
+
+func pickLayer(layers []ociDescriptor, cmdName string) (*ociDescriptor, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("manifest has no layers")
+	}
+	for i := range layers {
+		if layers[i].Annotations[annotationTitle] == cmdName {
+			return &layers[i], nil
+		}
+	}
+	if len(layers) == 1 {
+		return &layers[0], nil
+	}
+	return nil, fmt.Errorf("no layer titled %q in manifest", cmdName)
+}
+
+// OCITrigger polls a registry tag and offers the layer for the running
+// platform as the update. Use it together with an OCIRequester so blob
+// downloads carry the same credentials.
+type OCITrigger struct {
+	Dir               string        // store the next update time
+	Registry          string        // the registry base url, ex: https://ghcr.io
+	Repository        string        // the repository holding the artifact
+	Tag               string        // the tag to follow
+	CmdName           string        // the layer title of the binary
+	CheckTimeDuration time.Duration // how often to check for updates
+	Requester         *OCIRequester
+	Store             StateStore // Optional store of the next update time, defaults to the updater's, or a FileStateStore in Dir
+	log               Loggerr
+}
+
+func NewOCITrigger(
+	registry,
+	repository,
+	tag,
+	cmdName string,
+	dir string,
+	checkTimeDuration time.Duration,
+	requester *OCIRequester,
+	log Loggerr,
+) TriggerUpdater {
+	if requester == nil {
+		requester = NewOCIRequester()
+	}
+	return &OCITrigger{
+		Registry:          registry,
+		Repository:        repository,
+		Tag:               tag,
+		CmdName:           cmdName,
+		Dir:               dir,
+		CheckTimeDuration: checkTimeDuration,
+		Requester:         requester,
+		log:               log,
+	}
+}
+
+func (f *OCITrigger) Trigger(ctx context.Context) chan UpdatePackageInfo {
+	ch := make(chan UpdatePackageInfo)
+	checkTick := time.NewTicker(f.CheckTimeDuration)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-checkTick.C:
+				f.check(ctx, ch)
+			}
+		}
+	}()
+	return ch
+}
+
+func (f *OCITrigger) check(ctx context.Context, ch chan UpdatePackageInfo) {
+	// check for updates
+	if f.NextUpdate().Before(time.Now()) {
+		info, err := f.Requester.Resolve(ctx, f.Registry, f.Repository, f.Tag, f.CmdName)
+		if err != nil {
+			f.log.Log(zapcore.ErrorLevel, "error resolving oci manifest", zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+			return
+		}
+		if info.Version != "" {
+			ch <- *info
+		}
+		isComplate := f.SetUpdateTime()
+		if !isComplate {
+			f.log.Log(zapcore.ErrorLevel, "error setting next update time")
+			return
+		}
+	} else {
+		f.log.Log(zapcore.DebugLevel, "the next update checkpoint has not yet arrived")
+	}
+}
+
+func (f *OCITrigger) useStore(s StateStore) {
+	useScheduleStore(&f.Store, s)
+}
+
+// store returns Store, or a FileStateStore in Dir.
+func (f *OCITrigger) store() StateStore {
+	return scheduleStore(&f.Store, f.Dir)
+}
+
+func (f *OCITrigger) NextUpdate() time.Time {
+	return nextUpdate(f.store(), f.Dir, f.log)
+}
+
+// SetUpdateTime writes the next update time to the state store
+func (f *OCITrigger) SetUpdateTime() bool {
+	return setUpdateTime(f.store(), f.CheckTimeDuration, 3*time.Second, f.log)
+}
@@ -0,0 +1,318 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testRegistry is an in-process stand-in for an OCI distribution registry
+// serving one repository. With token set it answers requests without the
+// bearer token with a challenge pointing at its own /token endpoint, which
+// hands the token out for user:pass.
+type testRegistry struct {
+	repository string
+	token      string
+	blobs      map[string][]byte // digest -> content
+	manifests  map[string][]byte // tag or digest -> manifest
+	mediaTypes map[string]string // tag or digest -> media type
+	tokenCalls atomic.Int32
+	srv        *httptest.Server
+}
+
+func newTestRegistry(t *testing.T, repository, token string) *testRegistry {
+	r := &testRegistry{
+		repository: repository,
+		token:      token,
+		blobs:      map[string][]byte{},
+		manifests:  map[string][]byte{},
+		mediaTypes: map[string]string{},
+	}
+	r.srv = httptest.NewServer(r)
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+func digestOf(p []byte) string {
+	sum := sha256.Sum256(p)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (r *testRegistry) addBlob(p []byte) string {
+	d := digestOf(p)
+	r.blobs[d] = p
+	return d
+}
+
+// addManifest stores m under its digest and, if set, under tag.
+func (r *testRegistry) addManifest(t *testing.T, tag, mediaType string, m any) string {
+	t.Helper()
+	p, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := digestOf(p)
+	for _, ref := range []string{d, tag} {
+		if ref != "" {
+			r.manifests[ref] = p
+			r.mediaTypes[ref] = mediaType
+		}
+	}
+	return d
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.tokenCalls.Add(1)
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "user" || pass != "pass" || req.URL.Query().Get("scope") != "repository:"+r.repository+":pull" {
+			http.Error(w, "denied", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+	if r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull"`, r.srv.URL, r.repository))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	prefix := "/v2/" + r.repository + "/"
+	rest, ok := strings.CutPrefix(req.URL.Path, prefix)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	kind, ref, _ := strings.Cut(rest, "/")
+	switch kind {
+	case "manifests":
+		p, ok := r.manifests[ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", r.mediaTypes[ref])
+		w.Write(p)
+	case "blobs":
+		p, ok := r.blobs[ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(p)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// publish pushes layer as the single layer of a manifest for the running
+// platform, behind an index tagged tag. An empty version leaves out the
+// version annotation.
+func (r *testRegistry) publish(t *testing.T, tag, version string, layer ociDescriptor) {
+	t.Helper()
+	annotations := map[string]string{}
+	if version != "" {
+		annotations[annotationVersion] = version
+	}
+	manifest := r.addManifest(t, "", mediaTypeOCIManifest, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIManifest,
+		"layers":        []ociDescriptor{layer},
+		"annotations":   annotations,
+	})
+	r.addManifest(t, tag, mediaTypeOCIIndex, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIIndex,
+		"manifests": []map[string]any{
+			{"mediaType": mediaTypeOCIManifest, "digest": digestOf([]byte("another platform")),
+				"platform": map[string]string{"os": runtime.GOOS, "architecture": "none"}},
+			{"mediaType": mediaTypeOCIManifest, "digest": manifest,
+				"platform": map[string]string{"os": runtime.GOOS, "architecture": runtime.GOARCH}},
+		},
+	})
+}
+
+func gzipped(t *testing.T, p []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(p)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fetchResolved downloads info's artifact with o and decodes it the way
+// the updater does.
+func fetchResolved(t *testing.T, o *OCIRequester, info *UpdatePackageInfo) []byte {
+	t.Helper()
+	rc, err := o.FetchContext(context.Background(), info.DownloadUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	u := &Updater{Info: *info}
+	bin, err := u.decode(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+func TestOCIResolveAnonymous(t *testing.T) {
+	bin := []byte("uncompressed agent binary")
+	reg := newTestRegistry(t, "org/agent", "")
+	reg.publish(t, "stable", "1.2.0", ociDescriptor{
+		MediaType:   "application/octet-stream",
+		Digest:      reg.addBlob(bin),
+		Size:        int64(len(bin)),
+		Annotations: map[string]string{annotationTitle: "agent"},
+	})
+
+	o := NewOCIRequester()
+	info, err := o.Resolve(context.Background(), reg.srv.URL, "org/agent", "stable", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.2.0" {
+		t.Errorf("version %q, want 1.2.0", info.Version)
+	}
+	got := fetchResolved(t, o, info)
+	if !bytes.Equal(got, bin) || !verifySha(got, info.ContentHash) {
+		t.Errorf("fetched %q, content hash %x doesn't match", got, info.ContentHash)
+	}
+	if reg.tokenCalls.Load() != 0 {
+		t.Errorf("anonymous registry asked for %d tokens", reg.tokenCalls.Load())
+	}
+}
+
+func TestOCIResolveBearerToken(t *testing.T) {
+	bin := []byte("gzipped agent binary")
+	blob := gzipped(t, bin)
+	reg := newTestRegistry(t, "org/agent", "secret-token")
+	reg.publish(t, "stable", "1.3.0", ociDescriptor{
+		MediaType: "application/vnd.opamp.package.binary.v1+gzip",
+		Digest:    reg.addBlob(blob),
+		Size:      int64(len(blob)),
+		Annotations: map[string]string{
+			annotationTitle:         "agent",
+			AnnotationContentDigest: digestOf(bin),
+		},
+	})
+
+	o := &OCIRequester{Username: "user", Password: "pass"}
+	info, err := o.Resolve(context.Background(), reg.srv.URL, "org/agent", "stable", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Compression != CompressionGzip {
+		t.Errorf("compression %q, want gzip", info.Compression)
+	}
+	// the content hash is that of the binary, not of the gzipped blob
+	got := fetchResolved(t, o, info)
+	if !bytes.Equal(got, bin) || !verifySha(got, info.ContentHash) {
+		t.Errorf("fetched %q, content hash %x doesn't match", got, info.ContentHash)
+	}
+	// manifests and blobs of one repository share the token
+	if n := reg.tokenCalls.Load(); n != 1 {
+		t.Errorf("%d token requests, want 1", n)
+	}
+
+	denied := &OCIRequester{Username: "user", Password: "wrong"}
+	if _, err := denied.Resolve(context.Background(), reg.srv.URL, "org/agent", "stable", "agent"); err == nil {
+		t.Error("resolved with wrong credentials")
+	}
+	static := &OCIRequester{Token: "secret-token"}
+	if _, err := static.Resolve(context.Background(), reg.srv.URL, "org/agent", "stable", "agent"); err != nil {
+		t.Errorf("static token: %v", err)
+	}
+}
+
+func TestOCIResolveCompressedLayerNeedsContentDigest(t *testing.T) {
+	blob := gzipped(t, []byte("agent"))
+	reg := newTestRegistry(t, "org/agent", "")
+	reg.publish(t, "stable", "1.0.0", ociDescriptor{
+		MediaType: "application/vnd.opamp.package.binary.v1+gzip",
+		Digest:    reg.addBlob(blob),
+		Size:      int64(len(blob)),
+	})
+	_, err := NewOCIRequester().Resolve(context.Background(), reg.srv.URL, "org/agent", "stable", "agent")
+	if err == nil || !strings.Contains(err.Error(), AnnotationContentDigest) {
+		t.Errorf("got %v, want an error naming %s", err, AnnotationContentDigest)
+	}
+}
+
+func TestOCIResolveCarriesFileAttrs(t *testing.T) {
+	bin := []byte("agent with a policy")
+	reg := newTestRegistry(t, "org/agent", "")
+	reg.publish(t, "stable", "1.4.0", ociDescriptor{
+		MediaType: "application/octet-stream",
+		Digest:    reg.addBlob(bin),
+		Size:      int64(len(bin)),
+		Annotations: map[string]string{
+			annotationTitle:     "agent",
+			AnnotationFileAttrs: `{"mode":448}`,
+		},
+	})
+	info, err := NewOCIRequester().Resolve(context.Background(), reg.srv.URL, "org/agent", "stable", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPolicyApplied(t, *info)
+}
+
+func TestOCIResolveRejects(t *testing.T) {
+	bin := []byte("agent")
+	tests := []struct {
+		name    string
+		version string
+		layer   ociDescriptor
+		want    string
+	}{
+		{
+			name:  "floating tag without version",
+			layer: ociDescriptor{MediaType: "application/octet-stream", Digest: digestOf(bin)},
+			want:  annotationVersion,
+		},
+		{
+			name:    "tar layer",
+			version: "1.0.0",
+			layer:   ociDescriptor{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: digestOf(bin)},
+			want:    "tar archive",
+		},
+		{
+			name:    "docker tar layer",
+			version: "1.0.0",
+			layer:   ociDescriptor{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", Digest: digestOf(bin)},
+			want:    "tar archive",
+		},
+		{
+			name:    "short digest",
+			version: "1.0.0",
+			layer: ociDescriptor{MediaType: "application/octet-stream", Digest: digestOf(bin),
+				Annotations: map[string]string{AnnotationContentDigest: "sha256:abcd"}},
+			want: "2 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newTestRegistry(t, "org/agent", "")
+			reg.publish(t, "latest", tt.version, tt.layer)
+			_, err := NewOCIRequester().Resolve(context.Background(), reg.srv.URL, "org/agent", "latest", "agent")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/kr/binarydist"
+)
+
+// PatchAlgorithm identifies the delta encoding inside a patch container.
+type PatchAlgorithm byte
+
+const (
+	PatchBsdiff   PatchAlgorithm = 1 // bsdiff, as produced by binarydist
+	PatchZstdFrom PatchAlgorithm = 2 // zstd with the source binary as raw dictionary and a window spanning it
+)
+
+// Patch container layout:
+//
+//	magic     7 bytes "OPPATCH"
+//	version   1 byte, patchFormatVersion
+//	algorithm 1 byte, PatchAlgorithm
+//	source    32 bytes, sha256 of the binary the patch applies to
+//	target    32 bytes, sha256 of the binary it produces
+//	payload   the delta
+const (
+	patchMagic         = "OPPATCH"
+	patchFormatVersion = 1
+	patchHeaderSize    = len(patchMagic) + 2 + 2*sha256.Size
+
+	// zstdPatchDictID tags frames that need the source binary as dictionary.
+	zstdPatchDictID = 0x4f50
+)
+
+var ErrPatchSource = errors.New("patch was built from a different source binary")
+
+func (a PatchAlgorithm) String() string {
+	switch a {
+	case PatchBsdiff:
+		return "bsdiff"
+	case PatchZstdFrom:
+		return "zstd"
+	}
+	return fmt.Sprintf("PatchAlgorithm(%d)", byte(a))
+}
+
+// ParsePatchAlgorithm returns the algorithm called name, "bsdiff" or "zstd".
+func ParsePatchAlgorithm(name string) (PatchAlgorithm, error) {
+	for _, a := range []PatchAlgorithm{PatchBsdiff, PatchZstdFrom} {
+		if a.String() == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown patch algorithm %q", name)
+}
+
+// DiffPatch returns a patch container turning old into new.
+func DiffPatch(algorithm PatchAlgorithm, old, new []byte) ([]byte, error) {
+	source, target := sha256.Sum256(old), sha256.Sum256(new)
+	var buf bytes.Buffer
+	buf.WriteString(patchMagic)
+	buf.WriteByte(patchFormatVersion)
+	buf.WriteByte(byte(algorithm))
+	buf.Write(source[:])
+	buf.Write(target[:])
+	switch algorithm {
+	case PatchBsdiff:
+		if err := binarydist.Diff(bytes.NewReader(old), bytes.NewReader(new), &buf); err != nil {
+			return nil, err
+		}
+	case PatchZstdFrom:
+		enc, err := zstd.NewWriter(nil,
+			zstd.WithEncoderDictRaw(zstdPatchDictID, old),
+			zstd.WithWindowSize(patchWindow(len(old), len(new))),
+			zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+			zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(new, buf.Bytes()), nil
+	default:
+		return nil, fmt.Errorf("unknown patch algorithm %v", algorithm)
+	}
+	return buf.Bytes(), nil
+}
+
+// ApplyPatch turns old into the patched binary. Patch containers are
+// checked against the hashes in their header; anything else is taken to be
+// a bare bsdiff patch.
+func ApplyPatch(old []byte, patch []byte) ([]byte, error) {
+	if !bytes.HasPrefix(patch, []byte(patchMagic)) {
+		var buf bytes.Buffer
+		err := binarydist.Patch(bytes.NewReader(old), &buf, bytes.NewReader(patch))
+		return buf.Bytes(), err
+	}
+	if len(patch) < patchHeaderSize {
+		return nil, errors.New("truncated patch header")
+	}
+	header := patch[len(patchMagic):patchHeaderSize]
+	if header[0] != patchFormatVersion {
+		return nil, fmt.Errorf("unsupported patch format version %d", header[0])
+	}
+	algorithm := PatchAlgorithm(header[1])
+	source, target := header[2:2+sha256.Size], header[2+sha256.Size:]
+	if !verifySha(old, source) {
+		return nil, ErrPatchSource
+	}
+	payload := patch[patchHeaderSize:]
+
+	var bin []byte
+	switch algorithm {
+	case PatchBsdiff:
+		var buf bytes.Buffer
+		if err := binarydist.Patch(bytes.NewReader(old), &buf, bytes.NewReader(payload)); err != nil {
+			return nil, err
+		}
+		bin = buf.Bytes()
+	case PatchZstdFrom:
+		dec, err := zstd.NewReader(nil,
+			zstd.WithDecoderDictRaw(zstdPatchDictID, old),
+			zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		if bin, err = dec.DecodeAll(payload, nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown patch algorithm %v", algorithm)
+	}
+	if !verifySha(bin, target) {
+		return nil, ErrHashMismatch
+	}
+	return bin, nil
+}
+
+// patchWindow is the smallest zstd window reaching back over the whole
+// source binary from anywhere in the target.
+func patchWindow(oldSize, newSize int) int {
+	size := oldSize + newSize
+	w := zstd.MinWindowSize
+	for w < size && w < zstd.MaxWindowSize {
+		w <<= 1
+	}
+	return w
+}
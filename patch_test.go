@@ -0,0 +1,183 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/kr/binarydist"
+)
+
+// patchPair is a small old and new binary differing the way rebuilds do.
+func patchPair() (old, new []byte) {
+	rng := rand.New(rand.NewSource(2))
+	old = make([]byte, 64<<10)
+	rng.Read(old)
+	new = bytes.Clone(old)
+	for i := 0; i < 32; i++ {
+		new[rng.Intn(len(new))]++
+	}
+	return old, append(new, "appended section"...)
+}
+
+func TestPatchRoundTrip(t *testing.T) {
+	old, new := patchPair()
+	for _, algorithm := range []PatchAlgorithm{PatchBsdiff, PatchZstdFrom} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			patch, err := DiffPatch(algorithm, old, new)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(patch) >= len(new) {
+				t.Errorf("patch of %d bytes for a %d byte binary", len(patch), len(new))
+			}
+			bin, err := ApplyPatch(old, patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bin, new) {
+				t.Error("patched binary differs")
+			}
+
+			other := bytes.Clone(old)
+			other[0]++
+			if _, err := ApplyPatch(other, patch); !errors.Is(err, ErrPatchSource) {
+				t.Errorf("applied to the wrong source: got %v, want ErrPatchSource", err)
+			}
+		})
+	}
+}
+
+func TestApplyPatchDamagedContainer(t *testing.T) {
+	old, new := patchPair()
+	patch, err := DiffPatch(PatchZstdFrom, old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damage := func(f func(p []byte) []byte) []byte {
+		return f(bytes.Clone(patch))
+	}
+	tests := []struct {
+		name  string
+		patch []byte
+		want  error // nil for any error
+	}{
+		{name: "magic only", patch: []byte(patchMagic)},
+		{name: "truncated header", patch: patch[:patchHeaderSize-1]},
+		{name: "format version", patch: damage(func(p []byte) []byte { p[len(patchMagic)] = 9; return p })},
+		{name: "algorithm", patch: damage(func(p []byte) []byte { p[len(patchMagic)+1] = 9; return p })},
+		{name: "source hash", patch: damage(func(p []byte) []byte { p[len(patchMagic)+2]++; return p }), want: ErrPatchSource},
+		{name: "target hash", patch: damage(func(p []byte) []byte { p[patchHeaderSize-1]++; return p }), want: ErrHashMismatch},
+		{name: "truncated payload", patch: patch[:patchHeaderSize+(len(patch)-patchHeaderSize)/2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin, err := ApplyPatch(old, tt.patch)
+			if err == nil {
+				t.Fatalf("applied a damaged patch, got %d bytes", len(bin))
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// Patches published before the container existed are bare bsdiff.
+func TestApplyLegacyBsdiffPatch(t *testing.T) {
+	old, new := patchPair()
+	var patch bytes.Buffer
+	if err := binarydist.Diff(bytes.NewReader(old), bytes.NewReader(new), &patch); err != nil {
+		t.Fatal(err)
+	}
+	bin, err := ApplyPatch(old, patch.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bin, new) {
+		t.Error("patched binary differs")
+	}
+}
+
+// benchBinaries returns the pair of binaries the patch benchmarks run on:
+// OPAMP_PATCHBENCH_OLD and OPAMP_PATCHBENCH_NEW if set, ex: two builds of
+// cmd/updater, else the start of the test binary and a copy of it changed
+// the way a rebuild changes a Go binary, a few scattered bytes and a grown
+// section. bsdiff is too slow to diff the whole test binary on every run.
+func benchBinaries(b *testing.B) (old, new []byte) {
+	b.Helper()
+	if oldPath, newPath := os.Getenv("OPAMP_PATCHBENCH_OLD"), os.Getenv("OPAMP_PATCHBENCH_NEW"); oldPath != "" && newPath != "" {
+		var err error
+		if old, err = os.ReadFile(oldPath); err != nil {
+			b.Fatal(err)
+		}
+		if new, err = os.ReadFile(newPath); err != nil {
+			b.Fatal(err)
+		}
+		return old, new
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if old, err = os.ReadFile(exe); err != nil {
+		b.Fatal(err)
+	}
+	old = old[:min(len(old), 4<<20)]
+	rng := rand.New(rand.NewSource(1))
+	new = bytes.Clone(old)
+	for i := 0; i < len(new)/4096; i++ {
+		new[rng.Intn(len(new))] ^= byte(rng.Intn(255) + 1)
+	}
+	grown := make([]byte, 64<<10)
+	rng.Read(grown)
+	mid := len(new) / 2
+	new = append(new[:mid:mid], append(grown, new[mid:]...)...)
+	return old, new
+}
+
+var benchAlgorithms = []PatchAlgorithm{PatchBsdiff, PatchZstdFrom}
+
+func BenchmarkDiffPatch(b *testing.B) {
+	old, new := benchBinaries(b)
+	for _, algorithm := range benchAlgorithms {
+		b.Run(algorithm.String(), func(b *testing.B) {
+			var patch []byte
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if patch, err = DiffPatch(algorithm, old, new); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(patch)), "patch-bytes")
+		})
+	}
+}
+
+func BenchmarkApplyPatch(b *testing.B) {
+	old, new := benchBinaries(b)
+	for _, algorithm := range benchAlgorithms {
+		b.Run(algorithm.String(), func(b *testing.B) {
+			patch, err := DiffPatch(algorithm, old, new)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(new)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bin, err := ApplyPatch(old, patch)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if i == 0 && !bytes.Equal(bin, new) {
+					b.Fatal("patched binary does not match")
+				}
+			}
+			b.ReportMetric(float64(len(patch)), "patch-bytes")
+		})
+	}
+}
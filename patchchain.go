@@ -0,0 +1,145 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+var errNoPatch = errors.New("no patch leads from the running binary to the update")
+
+// PatchEdge is one patch offered by the manifest. Together the edges form a
+// graph over binaries keyed by their SHA-256, so an agent several releases
+// behind can still patch its way to the update.
+type PatchEdge struct {
+	From []byte `json:"from"`           // sha256 of the binary the patch applies to
+	To   []byte `json:"to"`             // sha256 of the binary it produces
+	Url  string `json:"url"`            // absolute, or relative to the artifact url of each mirror, ex: "../1.1/linux-amd64.<from hex>.patch"
+	Size int64  `json:"size,omitempty"` // bytes, the cost the planner minimises
+}
+
+// planPatchChain returns the chain of edges leading from source to target
+// with the smallest total size, and that size.
+func planPatchChain(edges []PatchEdge, source, target []byte) ([]PatchEdge, int64, bool) {
+	from, to := string(source), string(target)
+	dist := map[string]int64{from: 0}
+	prev := map[string]int{} // index of the edge each node was reached by
+	done := map[string]bool{}
+	for {
+		node, best := "", int64(-1)
+		for n, d := range dist {
+			if !done[n] && (best < 0 || d < best) {
+				node, best = n, d
+			}
+		}
+		if best < 0 {
+			return nil, 0, false
+		}
+		if node == to {
+			break
+		}
+		done[node] = true
+		for i, e := range edges {
+			if string(e.From) != node {
+				continue
+			}
+			cost := e.Size
+			if cost <= 0 {
+				cost = 1
+			}
+			if d, ok := dist[string(e.To)]; !ok || best+cost < d {
+				dist[string(e.To)] = best + cost
+				prev[string(e.To)] = i
+			}
+		}
+	}
+	var chain []PatchEdge
+	for n := to; n != from; n = string(edges[prev[n]].From) {
+		chain = append(chain, edges[prev[n]])
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, dist[to], true
+}
+
+// fetchAndVerifyPatchChain follows the cheapest chain of manifest patches
+// from oldBytes to the update, verifying the result of every step. It gives
+// up when the full artifact is known to be smaller than the chain.
+func (u *Updater) fetchAndVerifyPatchChain(ctx context.Context, oldBytes, oldHash []byte, onProgress func(Progress)) ([]byte, error) {
+	chain, cost, ok := planPatchChain(u.Info.Patches, oldHash, u.Info.ContentHash)
+	if !ok {
+		return nil, errNoPatch
+	}
+	if full := u.Info.artifactSize(); full > 0 && cost >= full {
+		return nil, errNoPatch
+	}
+	bin := oldBytes
+	for _, edge := range chain {
+		target := func(mirror string) string { return resolveURL(mirror, edge.Url) }
+		next, err := u.applyPatchEdge(ctx, bin, edge, target, onProgress)
+		if err != nil {
+			return nil, err
+		}
+		bin = next
+	}
+	return bin, nil
+}
+
+// applyPatchEdge turns cur into the binary edge.To, with the patch from the
+// cache or else downloaded from the url target derives from each mirror.
+func (u *Updater) applyPatchEdge(ctx context.Context, cur []byte, edge PatchEdge, target func(mirror string) string, onProgress func(Progress)) ([]byte, error) {
+	if u.Cache != nil {
+		if patch, err := u.Cache.GetPatch(edge.From, edge.To); err == nil {
+			if bin, err := ApplyPatch(cur, patch); err == nil && verifySha(bin, edge.To) {
+				return bin, nil
+			}
+		}
+	}
+	return u.withMirrorURLs(ctx, target, func(url string) ([]byte, error) {
+		patch, err := u.fetchPatch(ctx, url, onProgress)
+		if err != nil {
+			return nil, err
+		}
+		bin, err := ApplyPatch(cur, patch)
+		if err != nil {
+			return nil, err
+		}
+		if !verifySha(bin, edge.To) {
+			return nil, ErrHashMismatch
+		}
+		if u.Cache != nil && !isDryRun(ctx) {
+			_ = u.Cache.PutPatch(edge.From, edge.To, patch)
+		}
+		return bin, nil
+	})
+}
+
+// sourcePatchURL is where the patch from the binary with SHA-256 source to
+// the artifact at artifact is published:
+// <artifact without compression extension>.<source hex>.patch
+func sourcePatchURL(artifact string, source []byte) string {
+	for _, ext := range []string{".gz", ".zst", ".xz"} {
+		if strings.HasSuffix(artifact, ext) {
+			artifact = strings.TrimSuffix(artifact, ext)
+			break
+		}
+	}
+	return artifact + "." + hex.EncodeToString(source) + ".patch"
+}
+
+// resolveURL resolves ref against the artifact url base. Either may be a
+// plain file path.
+func resolveURL(base, ref string) string {
+	r, err := url.Parse(ref)
+	if err == nil && len(r.Scheme) > 1 || filepath.IsAbs(ref) {
+		return ref
+	}
+	if b, err := url.Parse(base); err == nil && len(b.Scheme) > 1 && r != nil {
+		return b.ResolveReference(r).String()
+	}
+	return filepath.Join(filepath.Dir(base), filepath.FromSlash(ref))
+}
@@ -0,0 +1,351 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+const (
+	// PeerService is the mDNS service peers announce themselves under.
+	PeerService = "_opamp-artifacts._tcp"
+	// peerArtifactPath prefixes the hex encoded content hash in peer urls.
+	peerArtifactPath = "/opamp/artifacts/"
+	// defaultPeerMaxSize bounds what is accepted from a single peer.
+	defaultPeerMaxSize = 1 << 30
+	// peerConnectTimeout is short, a peer on the LAN answers at once or is gone.
+	peerConnectTimeout = 5 * time.Second
+)
+
+// peerClient talks to peers directly: they are on the LAN, a proxy from
+// HTTP_PROXY would not reach them or would see every artifact go by.
+var peerClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 nil,
+	DialContext:           (&net.Dialer{Timeout: peerConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+	ResponseHeaderTimeout: DefaultHeaderTimeout,
+	MaxIdleConnsPerHost:   DefaultMaxIdlePerHost,
+	IdleConnTimeout:       DefaultPoolIdleTimeout,
+}}
+
+var ErrNoPeerArtifact = errors.New("no peer holds the artifact")
+
+// ArtifactStore holds verified binaries keyed by their SHA-256.
+type ArtifactStore interface {
+	Open(hash []byte) (io.ReadCloser, int64, error)
+	Put(hash []byte, bin []byte) error
+}
+
+// ArtifactFetcher is implemented by requesters that can produce a verified
+// binary from its content hash alone. The Updater asks them before
+// downloading patches or the full binary by url.
+type ArtifactFetcher interface {
+	FetchArtifact(ctx context.Context, hash []byte) ([]byte, error)
+}
+
+// ArtifactPublisher is implemented by requesters that want to keep
+// binaries the Updater has verified, e.g. to serve them to peers.
+type ArtifactPublisher interface {
+	PublishArtifact(hash []byte, bin []byte) error
+}
+
+// PeerStore is a directory of verified binaries named by their hex hash.
+type PeerStore struct {
+	Dir string
+}
+
+func NewPeerStore(dir string) *PeerStore {
+	return &PeerStore{Dir: dir}
+}
+
+func (s *PeerStore) path(hash []byte) string {
+	return filepath.Join(s.Dir, hex.EncodeToString(hash))
+}
+
+func (s *PeerStore) Open(hash []byte) (io.ReadCloser, int64, error) {
+	fp, err := os.Open(s.path(hash))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+	return fp, fi.Size(), nil
+}
+
+// Put stores bin if it matches hash.
+func (s *PeerStore) Put(hash []byte, bin []byte) error {
+	if !verifySha(bin, hash) {
+		return ErrHashMismatch
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(hash), bin, 0644)
+}
+
+// PeerServer serves the content of an ArtifactStore to other agents on the
+// LAN and optionally announces itself over mDNS.
+type PeerServer struct {
+	Addr     string // listen address, ex: ":7946" or "127.0.0.1:0"
+	Store    ArtifactStore
+	Announce bool   // announce the server as PeerService over mDNS
+	Instance string // mDNS instance name, defaults to the hostname
+
+	mu       sync.Mutex
+	listener net.Listener
+	server   *http.Server
+	mdns     *mdns.Server
+}
+
+func NewPeerServer(addr string, store ArtifactStore) *PeerServer {
+	return &PeerServer{Addr: addr, Store: store}
+}
+
+// Start listens on Addr and serves in the background. The returned address
+// is the one actually bound, useful when Addr asks for port 0.
+func (p *PeerServer) Start() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.listener != nil {
+		return "", errors.New("peer server already started")
+	}
+	l, err := net.Listen("tcp", p.Addr)
+	if err != nil {
+		return "", err
+	}
+	if p.Announce {
+		if p.mdns, err = p.announce(l.Addr().(*net.TCPAddr).Port); err != nil {
+			l.Close()
+			return "", err
+		}
+	}
+	p.listener = l
+	p.server = &http.Server{Handler: p, ReadHeaderTimeout: DefaultHeaderTimeout}
+	go p.server.Serve(l)
+	return l.Addr().String(), nil
+}
+
+func (p *PeerServer) announce(port int) (*mdns.Server, error) {
+	instance := p.Instance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	service, err := mdns.NewMDNSService(instance, PeerService, "", "", port, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return mdns.NewServer(&mdns.Config{Zone: service, Logger: log.New(ioutil.Discard, "", 0)})
+}
+
+// Close stops serving and withdraws the mDNS announcement.
+func (p *PeerServer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mdns != nil {
+		p.mdns.Shutdown()
+		p.mdns = nil
+	}
+	if p.server == nil {
+		return nil
+	}
+	err := p.server.Close()
+	p.server, p.listener = nil, nil
+	return err
+}
+
+func (p *PeerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	hash, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, peerArtifactPath))
+	if !strings.HasPrefix(r.URL.Path, peerArtifactPath) || err != nil || len(hash) != sha256.Size {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rc, size, err := p.Store.Open(hash)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == "HEAD" {
+		return
+	}
+	io.Copy(w, rc)
+}
+
+// PeerDiscovery lists the host:port of peers that may hold artifacts.
+type PeerDiscovery interface {
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// StaticPeers is a fixed peer list.
+type StaticPeers []string
+
+func (s StaticPeers) Peers(ctx context.Context) ([]string, error) {
+	return s, nil
+}
+
+// MDNSDiscovery finds peers announcing PeerService on the local network.
+type MDNSDiscovery struct {
+	Timeout time.Duration // how long to listen for answers, defaults to one second
+}
+
+func (m *MDNSDiscovery) Peers(ctx context.Context) ([]string, error) {
+	entries := make(chan *mdns.ServiceEntry, 32)
+	params := mdns.DefaultParams(PeerService)
+	params.Entries = entries
+	params.Timeout = orDefault(m.Timeout, time.Second)
+	params.Logger = log.New(ioutil.Discard, "", 0)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mdns.QueryContext(ctx, params)
+		close(entries)
+	}()
+	var peers []string
+	for e := range entries {
+		switch {
+		case e.AddrV4 != nil:
+			peers = append(peers, net.JoinHostPort(e.AddrV4.String(), strconv.Itoa(e.Port)))
+		case e.AddrV6IPAddr != nil:
+			peers = append(peers, net.JoinHostPort(e.AddrV6IPAddr.String(), strconv.Itoa(e.Port)))
+		}
+	}
+	return peers, <-errCh
+}
+
+// PeerRequester asks LAN peers for artifacts by content hash and falls
+// back to Requester for everything else. Peers are never trusted: a binary
+// is only accepted when its SHA-256 matches the manifest's content hash.
+type PeerRequester struct {
+	Requester               // fallback for url based fetches
+	Discovery PeerDiscovery // where to look for peers
+	Store     ArtifactStore // Optional store that verified binaries are published to
+	Client    *http.Client  // Optional client for peer requests, defaults to one that never goes through a proxy
+	Timeout   time.Duration // per peer limit, defaults to DefaultIdleTimeout
+	MaxSize   int64         // largest artifact accepted from a peer, defaults to 1 GiB
+}
+
+func NewPeerRequester(fallback Requester, discovery PeerDiscovery, store ArtifactStore) *PeerRequester {
+	return &PeerRequester{Requester: fallback, Discovery: discovery, Store: store}
+}
+
+func (p *PeerRequester) FetchContext(ctx context.Context, url string) (io.ReadCloser, error) {
+	return WithContext(p.Requester).FetchContext(ctx, url)
+}
+
+// FetchArtifact tries each discovered peer in turn and returns the first
+// binary whose hash matches.
+func (p *PeerRequester) FetchArtifact(ctx context.Context, hash []byte) ([]byte, error) {
+	if p.Store != nil {
+		if rc, _, err := p.Store.Open(hash); err == nil {
+			bin, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err == nil && verifySha(bin, hash) {
+				return bin, nil
+			}
+		}
+	}
+	if p.Discovery == nil {
+		return nil, ErrNoPeerArtifact
+	}
+	peers, err := p.Discovery.Peers(ctx)
+	if err != nil && len(peers) == 0 {
+		return nil, err
+	}
+	for _, peer := range peers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		bin, err := p.fetchFromPeer(ctx, peer, hash)
+		if err != nil {
+			continue
+		}
+		if !verifySha(bin, hash) {
+			// a broken or malicious peer, try the next one
+			continue
+		}
+		return bin, nil
+	}
+	return nil, ErrNoPeerArtifact
+}
+
+func (p *PeerRequester) fetchFromPeer(ctx context.Context, peer string, hash []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(p.Timeout, DefaultIdleTimeout))
+	defer cancel()
+	url := fmt.Sprintf("http://%s%s%s", peer, peerArtifactPath, hex.EncodeToString(hash))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := p.Client
+	if client == nil {
+		client = peerClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	maxSize := p.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultPeerMaxSize
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, fmt.Errorf("artifact from peer %s exceeds %d bytes", peer, maxSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// FetchRange is passed on to the fallback requester, which has to support
+// ranges.
+func (p *PeerRequester) FetchRange(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error) {
+	rr, ok := p.Requester.(RangeRequester)
+	if !ok {
+		return nil, fmt.Errorf("requester for %s does not support ranges", url)
+	}
+	return rr.FetchRange(ctx, url, offset, length)
+}
+
+// useHTTPClient is passed on to the fallback requester, peers are always
+// asked through Client.
+func (p *PeerRequester) useHTTPClient(c *http.Client) bool {
+	return useHTTPClient(p.Requester, c)
+}
+
+// PublishArtifact keeps bin in Store so the PeerServer can hand it out.
+func (p *PeerRequester) PublishArtifact(hash []byte, bin []byte) error {
+	if p.Store == nil {
+		return nil
+	}
+	return p.Store.Put(hash, bin)
+}
@@ -0,0 +1,109 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// peerNode is one agent on the loopback "LAN": its updater, the store it
+// keeps verified binaries in and the server handing them to the others.
+type peerNode struct {
+	updater *Updater
+	server  *PeerServer
+	addr    string
+}
+
+func startPeerNode(t *testing.T, store ArtifactStore) *peerNode {
+	t.Helper()
+	server := NewPeerServer("127.0.0.1:0", store)
+	addr, err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return &peerNode{server: server, addr: addr}
+}
+
+// lyingStore hands out the same wrong bytes for every hash.
+type lyingStore struct{}
+
+func (lyingStore) Open(hash []byte) (io.ReadCloser, int64, error) {
+	p := []byte("not the binary you asked for")
+	return io.NopCloser(bytes.NewReader(p)), int64(len(p)), nil
+}
+
+func (lyingStore) Put(hash []byte, bin []byte) error {
+	return nil
+}
+
+func TestPeersShareVerifiedArtifacts(t *testing.T) {
+	bin := bytes.Repeat([]byte("agent v2 "), 4096)
+	hash := sha256.Sum256(bin)
+	var originHits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originHits.Add(1)
+		w.Write(bin)
+	}))
+	defer origin.Close()
+
+	// a peer answering every request with the wrong bytes comes first
+	liar := startPeerNode(t, lyingStore{})
+	nodes := make([]*peerNode, 4)
+	for i := range nodes {
+		nodes[i] = startPeerNode(t, NewPeerStore(t.TempDir()))
+	}
+	for i, n := range nodes {
+		peers := StaticPeers{liar.addr}
+		for j, other := range nodes {
+			if j != i {
+				peers = append(peers, other.addr)
+			}
+		}
+		n.updater = &Updater{
+			Requester: NewPeerRequester(NewHTTPRequester(), peers, n.server.Store),
+			Logger:    nopLog{},
+			Store:     NewMemoryStateStore(),
+			Info: UpdatePackageInfo{
+				Version:     "2.0.0",
+				DownloadUrl: origin.URL + "/agent",
+				ContentHash: hash[:],
+				Compression: CompressionNone,
+			},
+		}
+	}
+
+	ctx := context.Background()
+	for i, n := range nodes {
+		got, source, err := n.updater.fetchVerified(ctx, bytes.NewReader(nil), nil)
+		if err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+		if !bytes.Equal(got, bin) {
+			t.Fatalf("node %d: got a different binary", i)
+		}
+		want := sourcePeer
+		if i == 0 {
+			// nobody has it yet
+			want = sourceFull
+		}
+		if source != want {
+			t.Errorf("node %d: fetched from %q, want %q", i, source, want)
+		}
+		n.updater.publish(got)
+	}
+	if n := originHits.Load(); n != 1 {
+		t.Errorf("origin served %d downloads, want 1", n)
+	}
+}
+
+func TestPeerClientBypassesProxy(t *testing.T) {
+	if peerClient.Transport.(*http.Transport).Proxy != nil {
+		t.Error("peer requests go through the proxy")
+	}
+}
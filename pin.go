@@ -0,0 +1,369 @@
+package opamppackagemgm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/mod/semver"
+)
+
+// pinPath is the pin file operators can drop into Dir, ex:
+//
+//	{"version": ">=1.4.0 <1.5.0", "reason": "INC-231", "until": "2026-11-01T00:00:00Z"}
+//	{"hold": true, "reason": "freeze during migration"}
+const pinPath = "pin.json"
+
+// StateKeyPin is where Pin and Hold keep the pin set through the API.
+const StateKeyPin = "pin"
+
+var ErrUpdateBlocked = errors.New("update blocked by a pin")
+
+// Pin constrains which versions may be installed, until it expires.
+//
+// Version is an exact version, ex: "1.4.2", or a semver range made of
+// comparisons joined by spaces (and) or "||" (or): ">=1.4.0 <1.5.0",
+// "~1.4.2" (1.4.x from 1.4.2), "^1.4.2" (1.x.x from 1.4.2), "1.4" or
+// "1.4.x". Hold blocks every update.
+type Pin struct {
+	Version string     `json:"version,omitempty"`
+	Hold    bool       `json:"hold,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+	Until   *time.Time `json:"until,omitempty"` // nil means until removed
+	Source  string     `json:"-"`               // the pin file's path, or "api"
+}
+
+// BlockedError reports an offered version a pin rules out.
+type BlockedError struct {
+	Version string
+	Pin     Pin
+}
+
+func (e *BlockedError) Error() string {
+	what := "held"
+	if !e.Pin.Hold {
+		what = "pinned to " + e.Pin.Version
+	}
+	msg := fmt.Sprintf("update to %s blocked: %s by %s", e.Version, what, e.Pin.Source)
+	if e.Pin.Reason != "" {
+		msg += " (" + e.Pin.Reason + ")"
+	}
+	if e.Pin.Until != nil {
+		msg += " until " + e.Pin.Until.Format(time.RFC3339)
+	}
+	return msg
+}
+
+func (e *BlockedError) Unwrap() error {
+	return ErrUpdateBlocked
+}
+
+func (p Pin) expired(now time.Time) bool {
+	return p.Until != nil && !now.Before(*p.Until)
+}
+
+// allows reports whether version may be installed under p.
+func (p Pin) allows(version string) (bool, error) {
+	if p.Hold {
+		return false, nil
+	}
+	if p.Version == "" {
+		return true, nil
+	}
+	return matchVersion(p.Version, version)
+}
+
+// Pin constrains updates until p.Until, replacing the pin set before
+// through the API. The pin file in Dir applies as well.
+func (u *Updater) Pin(p Pin) error {
+	if !p.Hold && p.Version != "" {
+		if _, err := matchVersion(p.Version, "0.0.0"); err != nil {
+			return err
+		}
+	}
+	p.Source = ""
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return u.store().Put(StateKeyPin, b)
+}
+
+// Hold blocks every update until until, the zero time meaning until
+// Unpin.
+func (u *Updater) Hold(reason string, until time.Time) error {
+	p := Pin{Hold: true, Reason: reason}
+	if !until.IsZero() {
+		p.Until = &until
+	}
+	return u.Pin(p)
+}
+
+// Unpin removes the pin set through the API; the pin file is left to
+// whoever wrote it.
+func (u *Updater) Unpin() error {
+	return u.store().Delete(StateKeyPin)
+}
+
+// Pins returns the pins in force: the pin file's and the API's, leaving
+// out the expired ones. A pin file that can't be read holds every update,
+// it was most likely written to stop them.
+func (u *Updater) Pins() ([]Pin, error) {
+	var pins []Pin
+	var errs []error
+	path := filepath.Join(u.getExecRelativeDir(u.Dir), pinPath)
+	if p, err := os.ReadFile(path); err == nil {
+		pin := Pin{}
+		if err := json.Unmarshal(p, &pin); err != nil {
+			errs = append(errs, fmt.Errorf("pin file %s: %w", path, err))
+			pin = Pin{Hold: true, Reason: "unreadable pin file"}
+		}
+		pin.Source = path
+		pins = append(pins, pin)
+	} else if !os.IsNotExist(err) {
+		errs = append(errs, err)
+		pins = append(pins, Pin{Hold: true, Reason: "unreadable pin file", Source: path})
+	}
+
+	if p, err := u.store().Get(StateKeyPin); err == nil {
+		pin := Pin{}
+		if err := json.Unmarshal(p, &pin); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w: %v", StateKeyPin, ErrStateCorrupt, err))
+			pin = Pin{Hold: true, Reason: "unreadable pin"}
+		}
+		pin.Source = "api"
+		pins = append(pins, pin)
+	} else if !errors.Is(err, ErrStateNotFound) {
+		errs = append(errs, err)
+		pins = append(pins, Pin{Hold: true, Reason: "unreadable pin", Source: "api"})
+	}
+
+	now := time.Now()
+	inForce := pins[:0]
+	for _, p := range pins {
+		if !p.expired(now) {
+			inForce = append(inForce, p)
+		}
+	}
+	return inForce, errors.Join(errs...)
+}
+
+// checkPins returns a *BlockedError if a pin rules out version.
+func (u *Updater) checkPins(version string) error {
+	pins, err := u.Pins()
+	if err != nil {
+		u.logger().Log(zapcore.ErrorLevel, "update: reading pins failed, holding updates",
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	}
+	for _, p := range pins {
+		ok, err := p.allows(version)
+		if err != nil {
+			// a range that doesn't parse can't be honoured, hold instead
+			if p.Reason != "" {
+				p.Reason += ", "
+			}
+			p.Reason += "invalid range: " + err.Error()
+			p.Hold = true
+		}
+		if !ok {
+			return &BlockedError{Version: version, Pin: p}
+		}
+	}
+	return nil
+}
+
+// blocked logs and journals an offer a pin ruled out.
+func (u *Updater) blocked(err *BlockedError) {
+	u.logger().Log(zapcore.WarnLevel, "update: offer blocked by a pin",
+		zapcore.Field{Key: "version", Type: zapcore.StringType, String: err.Version},
+		zapcore.Field{Key: "hold", Type: zapcore.BoolType, Integer: boolInt(err.Pin.Hold)},
+		zapcore.Field{Key: "pin", Type: zapcore.StringType, String: err.Pin.Version},
+		zapcore.Field{Key: "reason", Type: zapcore.StringType, String: err.Pin.Reason},
+		zapcore.Field{Key: "source", Type: zapcore.StringType, String: err.Pin.Source})
+	if u.HistoryMaxBytes < 0 {
+		return
+	}
+	e := HistoryEntry{Time: time.Now(), From: u.CurrentVersion, To: err.Version, Outcome: OutcomeBlocked, Error: err.Error()}
+	if werr := u.appendHistory(e); werr != nil {
+		u.logger().Log(zapcore.WarnLevel, "update: writing the history journal failed",
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: werr})
+	}
+}
+
+// matchVersion reports whether version satisfies constraint, see Pin.
+func matchVersion(constraint, version string) (bool, error) {
+	if strings.TrimSpace(constraint) == version {
+		// exact pins work for versions that aren't semver too
+		return true, nil
+	}
+	v := canonicalVersion(version)
+	// every alternative is checked, a broken one is an error whatever
+	// version is offered
+	matched := false
+	for _, alternative := range strings.Split(constraint, "||") {
+		terms, err := rangeTerms(alternative)
+		if err != nil {
+			return false, fmt.Errorf("%w in %q", err, constraint)
+		}
+		all := true
+		for _, term := range terms {
+			ok, err := matchTerm(term, v)
+			if err != nil {
+				return false, err
+			}
+			all = all && ok
+		}
+		matched = matched || all
+	}
+	return matched, nil
+}
+
+// rangeOps are the operators of a range term, longest first.
+var rangeOps = []string{">=", "<=", ">", "<", "=", "~", "^"}
+
+// rangeTerms splits a range into its comparisons, joining an operator
+// written apart from its version, ex: ">= 1.4.0".
+func rangeTerms(alternative string) ([]string, error) {
+	fields := strings.Fields(alternative)
+	if len(fields) == 0 {
+		return nil, errors.New("empty version range")
+	}
+	var terms []string
+	for i := 0; i < len(fields); i++ {
+		term := fields[i]
+		for _, o := range rangeOps {
+			if term == o {
+				if i+1 == len(fields) {
+					return nil, fmt.Errorf("operator %s without a version", o)
+				}
+				i++
+				term += fields[i]
+				break
+			}
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// matchTerm checks one comparison against the canonical version v.
+func matchTerm(term, v string) (bool, error) {
+	op := ""
+	for _, o := range rangeOps {
+		if strings.HasPrefix(term, o) {
+			op, term = o, term[len(o):]
+			break
+		}
+	}
+	if term == "*" || term == "x" || term == "X" {
+		return semver.IsValid(v), nil
+	}
+	parts, wild, err := parseVersionPrefix(term)
+	if err != nil {
+		return false, err
+	}
+	if (op == "" || op == "=") && len(parts) < 3 {
+		// "1.4" is 1.4.x
+		wild = true
+	}
+	if !semver.IsValid(v) {
+		return false, nil
+	}
+	low := canonicalVersion(term)
+	if wild {
+		low = versionString(parts)
+	}
+	cmp := semver.Compare(v, low)
+	switch op {
+	case ">=":
+		return cmp >= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case "<":
+		return cmp < 0, nil
+	}
+	var high string
+	switch {
+	case op == "^":
+		// the first non-zero part may not change
+		switch {
+		case parts[0] > 0 || len(parts) == 1:
+			high = versionString([]int{parts[0] + 1})
+		case parts[1] > 0 || len(parts) == 2:
+			high = versionString([]int{0, parts[1] + 1})
+		default:
+			high = versionString([]int{0, 0, parts[2] + 1})
+		}
+	case op == "~" && len(parts) == 1:
+		high = versionString([]int{parts[0] + 1})
+	case op == "~", wild:
+		last := len(parts) - 1
+		if op == "~" && last > 1 {
+			last = 1
+		}
+		next := append([]int(nil), parts[:last+1]...)
+		next[last]++
+		high = versionString(next)
+	default:
+		return cmp == 0, nil
+	}
+	return cmp >= 0 && semver.Compare(v, high) < 0, nil
+}
+
+// parseVersionPrefix parses the numbers of a version that may stop early
+// or end in a wildcard, ex: "1.4", "1.4.x", "v2". Prerelease and build
+// suffixes are ignored, the numbers are what ranges are built from.
+func parseVersionPrefix(s string) ([]int, bool, error) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	var parts []int
+	for i, f := range strings.Split(s, ".") {
+		if f == "x" || f == "X" || f == "*" {
+			if i == 0 {
+				return nil, false, fmt.Errorf("invalid version %q", s)
+			}
+			return parts, true, nil
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 || i > 2 {
+			return nil, false, fmt.Errorf("invalid version %q", s)
+		}
+		parts = append(parts, n)
+	}
+	return parts, false, nil
+}
+
+// versionString renders parts as a semver version, missing parts are 0.
+func versionString(parts []int) string {
+	out := "v"
+	for i := 0; i < 3; i++ {
+		n := 0
+		if i < len(parts) {
+			n = parts[i]
+		}
+		if i > 0 {
+			out += "."
+		}
+		out += strconv.Itoa(n)
+	}
+	return out
+}
+
+// canonicalVersion returns version in the form semver expects, with the
+// leading "v" and missing parts filled in, ex: "1.4" is "v1.4.0".
+func canonicalVersion(version string) string {
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	return semver.Canonical(version)
+}
@@ -0,0 +1,131 @@
+package opamppackagemgm
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchVersion(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		// exact
+		{"1.4.2", "1.4.2", true},
+		{"1.4.2", "v1.4.2", true},
+		{"=1.4.2", "1.4.3", false},
+		{"nightly-20261001", "nightly-20261001", true},
+		{"1.4.2", "nightly-20261001", false},
+		// prefix and wildcards
+		{"1.4", "1.4.9", true},
+		{"1.4", "1.5.0", false},
+		{"1.4.x", "1.4.0", true},
+		{"1.x", "1.9.3", true},
+		{"1.x", "2.0.0", false},
+		{"*", "3.1.4", true},
+		// comparisons, with and without a space after the operator
+		{">=1.4.0", "1.4.0", true},
+		{">=1.4.0", "1.3.9", false},
+		{">= 1.4.0", "1.4.1", true},
+		{">= 1.4.0", "1.3.9", false},
+		{"<1.5.0", "1.4.9", true},
+		{"< 1.5.0", "1.5.0", false},
+		{">1.4.0", "1.4.0", false},
+		{"<=1.4.0", "1.4.0", true},
+		// ranges
+		{">=1.4.0 <1.5.0", "1.4.7", true},
+		{">=1.4.0 <1.5.0", "1.5.0", false},
+		{">= 1.4.0 < 1.5.0", "1.4.7", true},
+		{"~1.4.2", "1.4.9", true},
+		{"~1.4.2", "1.4.1", false},
+		{"~1.4.2", "1.5.0", false},
+		{"^1.4.2", "1.9.0", true},
+		{"^1.4.2", "2.0.0", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"1.2.x || >=2.0.0", "1.2.5", true},
+		{"1.2.x || >=2.0.0", "1.3.0", false},
+		{"1.2.x || >= 2.0.0", "2.1.0", true},
+		// prereleases order before their release
+		{"1.5.0-rc.1", "1.5.0-rc.1", true},
+		{"1.5.0-rc.1", "1.5.0", false},
+		{">=1.5.0-rc.1", "1.5.0-rc.2", true},
+		{">=1.5.0-rc.1", "1.5.0-beta.1", false},
+		{">=1.5.0-rc.1", "1.5.0", true},
+		{"<1.5.0", "1.5.0-rc.1", true},
+		// a version that isn't semver matches no range
+		{">=1.0.0", "nightly-20261001", false},
+	}
+	for _, tt := range tests {
+		got, err := matchVersion(tt.constraint, tt.version)
+		if err != nil {
+			t.Errorf("matchVersion(%q, %q): %v", tt.constraint, tt.version, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("matchVersion(%q, %q) = %v, want %v", tt.constraint, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestMatchVersionInvalid(t *testing.T) {
+	for _, constraint := range []string{
+		">=abc",
+		"1.2.3.4",
+		">=",
+		">=1.0.0 <",
+		"x.1",
+		"1.4 ||",
+		"^",
+		"~v",
+	} {
+		if _, err := matchVersion(constraint, "1.4.0"); err == nil {
+			t.Errorf("matchVersion(%q) accepted an invalid range", constraint)
+		}
+	}
+}
+
+func TestCheckPinsSpacedRange(t *testing.T) {
+	dir := t.TempDir()
+	u := &Updater{ExecutablePath: filepath.Join(dir, "agent"), Logger: nopLog{}, Store: NewMemoryStateStore()}
+	if err := os.WriteFile(filepath.Join(dir, pinPath), []byte(`{"version": ">= 1.4.0 < 1.5.0", "reason": "INC-231"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.checkPins("1.4.2"); err != nil {
+		t.Errorf("1.4.2 blocked: %v", err)
+	}
+	var blocked *BlockedError
+	if err := u.checkPins("1.5.0"); !errors.As(err, &blocked) || blocked.Pin.Hold {
+		t.Errorf("1.5.0: got %v, want blocked by the range rather than held", err)
+	}
+}
+
+func TestPinUntilJSON(t *testing.T) {
+	p, err := json.Marshal(Pin{Hold: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(p), "until") {
+		t.Errorf("a pin without expiry marshals as %s", p)
+	}
+
+	u := &Updater{ExecutablePath: filepath.Join(t.TempDir(), "agent"), Logger: nopLog{}, Store: NewMemoryStateStore()}
+	if err := u.Hold("migration", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.checkPins("1.4.2"); err != nil {
+		t.Errorf("expired hold still blocks: %v", err)
+	}
+	if err := u.Hold("migration", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.checkPins("1.4.2"); !errors.Is(err, ErrUpdateBlocked) {
+		t.Errorf("hold without expiry: got %v, want blocked", err)
+	}
+}
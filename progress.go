@@ -0,0 +1,115 @@
+package opamppackagemgm
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// progressInterval limits how often OnProgress is called while a download
+// is running; the final call is always made.
+const progressInterval = 200 * time.Millisecond
+
+// Progress describes a running download.
+type Progress struct {
+	Source string  // "patch" or "full"
+	URL    string  // the url being downloaded
+	Done   int64   // bytes received so far
+	Total  int64   // expected size in bytes, -1 when the server didn't say
+	Rate   float64 // average bytes per second since the download started
+}
+
+// Sizer is implemented by bodies that know their length up front, such as
+// the ones returned by HTTPRequester. Wrappers should pass it through.
+type Sizer interface {
+	Size() int64
+}
+
+func readerSize(r io.Reader) int64 {
+	if s, ok := r.(Sizer); ok {
+		return s.Size()
+	}
+	return -1
+}
+
+// progressReader reports the bytes read through it to fn.
+type progressReader struct {
+	rc       io.ReadCloser
+	fn       func(Progress)
+	progress Progress
+	start    time.Time
+	last     time.Time
+	once     sync.Once
+}
+
+func newProgressReader(rc io.ReadCloser, source, url string, fn func(Progress)) io.ReadCloser {
+	if fn == nil {
+		return rc
+	}
+	now := time.Now()
+	p := &progressReader{
+		rc:       rc,
+		fn:       fn,
+		progress: Progress{Source: source, URL: url, Total: readerSize(rc)},
+		start:    now,
+		last:     now,
+	}
+	// a retry of the same url starts again from zero, see byteTally
+	fn(p.progress)
+	return p
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.rc.Read(b)
+	p.progress.Done += int64(n)
+	now := time.Now()
+	if err == io.EOF {
+		p.report(now)
+	} else if now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.emit(now)
+	}
+	return n, err
+}
+
+func (p *progressReader) Size() int64 {
+	return p.progress.Total
+}
+
+func (p *progressReader) Close() error {
+	p.report(time.Now())
+	return p.rc.Close()
+}
+
+// report emits the final state exactly once.
+func (p *progressReader) report(now time.Time) {
+	p.once.Do(func() { p.emit(now) })
+}
+
+func (p *progressReader) emit(now time.Time) {
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		p.progress.Rate = float64(p.progress.Done) / elapsed
+	}
+	p.fn(p.progress)
+}
+
+// byteTally sums the bytes downloaded by every stream reported through
+// OnProgress. When Done goes back, because a stream starts again from zero,
+// ex: a retry of the same url, or a chunked download drops a failed chunk,
+// counting resumes from there; the bytes up to the last report before are
+// already counted.
+type byteTally struct {
+	mu    sync.Mutex
+	last  map[string]int64
+	total int64
+}
+
+func (t *byteTally) add(p Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := p.Source + " " + p.URL
+	if last := t.last[key]; p.Done > last {
+		t.total += p.Done - last
+	}
+	t.last[key] = p.Done
+}
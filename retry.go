@@ -0,0 +1,293 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// RetryPolicy controls how artifact downloads are retried across mirrors.
+type RetryPolicy struct {
+	MaxAttempts    int           // total attempts over all mirrors
+	InitialBackoff time.Duration // wait after the first round of failures
+	MaxBackoff     time.Duration // upper bound of the doubling backoff
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    6,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+type errorClass int
+
+const (
+	classRetry      errorClass = iota // transient, the same mirror may succeed later
+	classSkipMirror                   // this mirror won't serve the artifact, try the others
+	classFatal                        // give up on every mirror
+)
+
+// IsRetryable reports whether err is transient, such as a network failure,
+// a stalled download or a 5xx/429 answer. Errors can opt in or out by
+// implementing `Retryable() bool`.
+func IsRetryable(err error) bool {
+	return classifyError(err) == classRetry
+}
+
+func classifyError(err error) errorClass {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return classFatal
+	}
+	var r interface{ Retryable() bool }
+	if errors.As(err, &r) {
+		if r.Retryable() {
+			return classRetry
+		}
+		return classSkipMirror
+	}
+	if errors.Is(err, ErrHashMismatch) || errors.Is(err, ErrPatchSource) {
+		return classSkipMirror
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch code := statusErr.StatusCode; {
+		case code == 408, code == 425, code == 429, code >= 500:
+			return classRetry
+		default:
+			return classSkipMirror
+		}
+	}
+	if errors.Is(err, ErrIdleTimeout) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return classRetry
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		var opErr *net.OpError
+		var dnsErr *net.DNSError
+		if urlErr.Timeout() || errors.As(urlErr.Err, &opErr) || errors.As(urlErr.Err, &dnsErr) || errors.Is(urlErr.Err, io.EOF) {
+			return classRetry
+		}
+		// malformed url, unsupported scheme and the like
+		return classSkipMirror
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return classRetry
+	}
+	// unknown errors, e.g. a corrupt gzip stream, are unlikely to go away
+	// by asking the same mirror again
+	return classSkipMirror
+}
+
+// mirrorHealth is what is remembered about a mirror between updates.
+type mirrorHealth struct {
+	Successes           int       `json:"successes"`
+	Failures            int       `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// mirrorHealthStore persists mirrorHealth keyed by mirror url in the
+// updater's StateStore.
+type mirrorHealthStore struct {
+	store StateStore
+	log   Loggerr
+	mu    sync.Mutex
+}
+
+// load returns the recorded health. Damaged records are reported and
+// forgotten, the mirrors start over with a clean slate.
+func (s *mirrorHealthStore) load() map[string]*mirrorHealth {
+	health := make(map[string]*mirrorHealth)
+	p, err := s.store.Get(StateKeyMirrors)
+	if errors.Is(err, ErrStateNotFound) {
+		return health
+	}
+	if err == nil {
+		if err = json.Unmarshal(p, &health); err == nil {
+			return health
+		}
+		err = fmt.Errorf("%s: %w: %v", StateKeyMirrors, ErrStateCorrupt, err)
+	}
+	s.log.Log(zapcore.ErrorLevel, "update: reading mirror health failed",
+		zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	return make(map[string]*mirrorHealth)
+}
+
+func (s *mirrorHealthStore) record(mirror string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	health := s.load()
+	h := health[mirror]
+	if h == nil {
+		h = &mirrorHealth{}
+		health[mirror] = h
+	}
+	if err == nil {
+		h.Successes++
+		h.ConsecutiveFailures = 0
+		h.LastSuccess = time.Now()
+	} else {
+		h.Failures++
+		h.ConsecutiveFailures++
+		h.LastFailure = time.Now()
+		h.LastError = err.Error()
+	}
+	p, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := s.store.Put(StateKeyMirrors, p); err != nil {
+		s.log.Log(zapcore.WarnLevel, "update: recording mirror health failed",
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	}
+}
+
+// order sorts mirrors so that the healthiest come first; mirrors that are
+// equally healthy are shuffled by weight.
+func (s *mirrorHealthStore) order(mirrors []Mirror) []Mirror {
+	s.mu.Lock()
+	health := s.load()
+	s.mu.Unlock()
+
+	type ranked struct {
+		Mirror
+		failures int
+		key      float64
+	}
+	list := make([]ranked, len(mirrors))
+	for i, m := range mirrors {
+		weight := m.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		list[i] = ranked{Mirror: m, key: math.Pow(rand.Float64(), 1/float64(weight))}
+		if h := health[m.Url]; h != nil {
+			list[i].failures = h.ConsecutiveFailures
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].failures != list[j].failures {
+			return list[i].failures < list[j].failures
+		}
+		return list[i].key > list[j].key
+	})
+	out := make([]Mirror, len(list))
+	for i := range list {
+		out[i] = list[i].Mirror
+	}
+	return out
+}
+
+// mirrorHealth returns the health store of the updater, or the scratch
+// copy a dry run records to.
+func (u *Updater) mirrorHealth(ctx context.Context) *mirrorHealthStore {
+	if h, ok := ctx.Value(dryRunKey{}).(*mirrorHealthStore); ok {
+		return h
+	}
+	u.healthOnce.Do(func() {
+		u.health = &mirrorHealthStore{store: u.store(), log: u.logger()}
+	})
+	return u.health
+}
+
+func (u *Updater) retryPolicy() RetryPolicy {
+	p := DefaultRetryPolicy
+	if u.Retry != nil {
+		p = *u.Retry
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 1
+	}
+	return p
+}
+
+// withMirrors runs try against each mirror url (plus suffix) until one
+// succeeds. Transient errors keep the mirror in rotation and back off after
+// every round, other errors drop the mirror, fatal errors stop at once.
+func (u *Updater) withMirrors(ctx context.Context, suffix string, try func(url string) ([]byte, error)) ([]byte, error) {
+	return u.withMirrorURLs(ctx, func(mirror string) string { return mirror + suffix }, try)
+}
+
+// withMirrorURLs is withMirrors with the url derived from each mirror by
+// target.
+func (u *Updater) withMirrorURLs(ctx context.Context, target func(mirror string) string, try func(url string) ([]byte, error)) ([]byte, error) {
+	store := u.mirrorHealth(ctx)
+	active := store.order(u.Info.mirrors())
+	if len(active) == 0 {
+		return nil, errors.New("update has no download url")
+	}
+	policy := u.retryPolicy()
+	backoff := policy.InitialBackoff
+
+	var lastErr error
+	for attempt, i := 0, 0; attempt < policy.MaxAttempts && len(active) > 0; attempt++ {
+		if i >= len(active) {
+			// a full round failed, wait before going around again
+			i = 0
+			if err := sleepContext(ctx, backoff); err != nil {
+				return nil, err
+			}
+			backoff *= 2
+			if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		}
+		mirror := active[i]
+		url := target(mirror.Url)
+		bin, err := try(url)
+		store.record(mirror.Url, err)
+		if err == nil {
+			return bin, nil
+		}
+		lastErr = err
+		class := classifyError(err)
+		u.logger().Log(zapcore.WarnLevel, "update: download failed",
+			zapcore.Field{Key: "url", Type: zapcore.StringType, String: url},
+			zapcore.Field{Key: "retryable", Type: zapcore.BoolType, Integer: boolInt(class == classRetry)},
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		switch class {
+		case classFatal:
+			return nil, err
+		case classSkipMirror:
+			active = append(active[:i:i], active[i+1:]...)
+		default:
+			i++
+		}
+	}
+	return nil, lastErr
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
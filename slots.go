@@ -0,0 +1,173 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Slot installs keep two version directories under SlotsDir and a
+// symlink naming the active one:
+//
+//	SlotsDir/a/agent
+//	SlotsDir/b/agent
+//	SlotsDir/current -> a
+//
+// An update is written to the inactive slot, the executable under its own
+// name or a bundle as the whole slot, and current is switched to it by
+// renaming a new symlink over it. Nothing that is running is ever
+// replaced, and the previous version stays in its slot for RollbackSlot.
+const (
+	SlotA       = "a"
+	SlotB       = "b"
+	currentSlot = "current"
+)
+
+var ErrNoPreviousSlot = errors.New("no previous slot to roll back to")
+
+// activeSlot returns the slot current points at, "" before the first slot
+// install.
+func (u *Updater) activeSlot() (string, error) {
+	link := filepath.Join(u.SlotsDir, currentSlot)
+	target, err := os.Readlink(link)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	switch slot := filepath.Base(target); slot {
+	case SlotA, SlotB:
+		return slot, nil
+	}
+	return "", fmt.Errorf("%s points at %q, not a slot", link, target)
+}
+
+// otherSlot returns the slot that isn't slot, SlotA if there is none yet.
+func otherSlot(slot string) string {
+	if slot == SlotA {
+		return SlotB
+	}
+	return SlotA
+}
+
+// inactiveSlotDir returns the directory the next update is written to.
+func (u *Updater) inactiveSlotDir() (string, error) {
+	active, err := u.activeSlot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.SlotsDir, otherSlot(active)), nil
+}
+
+// installSlot writes the update to the inactive slot, runs the pre-install
+// hook there and switches current to it. It returns the slot's directory.
+func (u *Updater) installSlot(ctx context.Context, exe string, bin []byte) (string, error) {
+	dir, err := u.inactiveSlotDir()
+	if err != nil {
+		return "", err
+	}
+	// whatever is left there is the version before the previous one
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := u.writeSlot(dir, exe, bin); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	if err := u.runHook(ctx, HookPreInstall, dir, exe); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	u.stage(dir)
+	if err := u.switchSlot(filepath.Base(dir)); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// writeSlot fills dir with the update, giving the new executable the
+// attributes of the running one.
+func (u *Updater) writeSlot(dir, exe string, bin []byte) error {
+	if u.Info.Bundle == nil {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := writeSynced(filepath.Join(dir, filepath.Base(exe)), bin, 0755, u.attrPreparer(exe)); err != nil {
+			return err
+		}
+		return syncDir(dir)
+	}
+	if err := extractBundle(bin, u.Info.Bundle.Format, dir); err != nil {
+		return err
+	}
+	newMain, err := bundleMain(dir, u.Info.Bundle.Main)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(exe); err == nil {
+		return u.attrPreparer(exe)(newMain)
+	}
+	return nil
+}
+
+// switchSlot points current at slot by renaming a new symlink over it, so
+// current always names a complete version. The link is relative, the
+// slots can be mounted elsewhere.
+func (u *Updater) switchSlot(slot string) error {
+	link := filepath.Join(u.SlotsDir, currentSlot)
+	newLink, _ := stagingPaths(link)
+	_ = os.Remove(newLink)
+	if err := os.Symlink(slot, newLink); err != nil {
+		return err
+	}
+	if err := os.Rename(newLink, link); err != nil {
+		_ = os.Remove(newLink)
+		return err
+	}
+	return syncDir(u.SlotsDir)
+}
+
+// revertSlot undoes the switch to slot: current goes back to the other
+// slot if it holds a version, and is removed if it doesn't.
+func (u *Updater) revertSlot(slot string) error {
+	previous := otherSlot(slot)
+	if fi, err := os.Stat(filepath.Join(u.SlotsDir, previous)); err == nil && fi.IsDir() {
+		return u.switchSlot(previous)
+	}
+	if err := os.Remove(filepath.Join(u.SlotsDir, currentSlot)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(u.SlotsDir)
+}
+
+// RollbackSlot switches current back to the other slot, which holds the
+// version installed before the active one. The running process keeps
+// running the version it started with.
+func (u *Updater) RollbackSlot() error {
+	active, err := u.activeSlot()
+	if err != nil {
+		return err
+	}
+	if active == "" {
+		return ErrNoPreviousSlot
+	}
+	previous := otherSlot(active)
+	if fi, err := os.Stat(filepath.Join(u.SlotsDir, previous)); err != nil || !fi.IsDir() {
+		return ErrNoPreviousSlot
+	}
+	return u.switchSlot(previous)
+}
+
+// recoverSlots drops the symlink of a switch that was interrupted; current
+// itself is always whole. A half written slot is overwritten by the next
+// update.
+func (u *Updater) recoverSlots() error {
+	newLink, _ := stagingPaths(filepath.Join(u.SlotsDir, currentSlot))
+	if err := os.Remove(newLink); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
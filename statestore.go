@@ -0,0 +1,188 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Keys of the state kept in a StateStore.
+const (
+	StateKeySchedule = "schedule" // time of the next update check
+	StateKeyMirrors  = "mirrors"  // download failures per mirror, for backoff
+	StateKeyUpdate   = "update"   // the update in flight or last confirmed, see UpdateState
+)
+
+var (
+	ErrStateNotFound = errors.New("state not found")
+	ErrStateCorrupt  = errors.New("state is corrupt")
+)
+
+// StateStore keeps the small records the updater and its triggers need
+// across restarts. Get returns ErrStateNotFound for a key never written
+// and an error wrapping ErrStateCorrupt for a value that was damaged, ex:
+// by a torn write or a failing disk.
+type StateStore interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+}
+
+// stateUser is implemented by triggers that persist state. The Updater
+// hands them its Store unless they have one already.
+type stateUser interface {
+	useStore(s StateStore)
+}
+
+// Values are sealed with their checksum so damage is told apart from an
+// empty or missing record:
+//
+//	sha256:<hex of the value>\n<value>
+const stateSealPrefix = "sha256:"
+
+func sealState(value []byte) []byte {
+	sum := sha256.Sum256(value)
+	out := make([]byte, 0, len(stateSealPrefix)+2*sha256.Size+1+len(value))
+	out = append(out, stateSealPrefix...)
+	out = hex.AppendEncode(out, sum[:])
+	out = append(out, '\n')
+	return append(out, value...)
+}
+
+func unsealState(key string, sealed []byte) ([]byte, error) {
+	header, value, ok := bytes.Cut(sealed, []byte{'\n'})
+	if !ok || !bytes.HasPrefix(header, []byte(stateSealPrefix)) {
+		return nil, fmt.Errorf("%s: %w: no checksum", key, ErrStateCorrupt)
+	}
+	want, err := hex.DecodeString(string(header[len(stateSealPrefix):]))
+	if err != nil || !verifySha(value, want) {
+		return nil, fmt.Errorf("%s: %w: checksum mismatch", key, ErrStateCorrupt)
+	}
+	return value, nil
+}
+
+// checkStateKey rejects keys that can't be used as a file name.
+func checkStateKey(key string) error {
+	if key == "" || strings.ContainsAny(key, `/\`) || !filepath.IsLocal(key) {
+		return fmt.Errorf("invalid state key %q", key)
+	}
+	return nil
+}
+
+// FileStateStore keeps every key in a file of its own in Dir, replaced
+// atomically on Put.
+type FileStateStore struct {
+	Dir string
+}
+
+func NewFileStateStore(dir string) *FileStateStore {
+	return &FileStateStore{Dir: dir}
+}
+
+func (s *FileStateStore) Get(key string) ([]byte, error) {
+	if err := checkStateKey(key); err != nil {
+		return nil, err
+	}
+	p, err := os.ReadFile(filepath.Join(s.Dir, key))
+	if os.IsNotExist(err) {
+		return nil, ErrStateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unsealState(key, p)
+}
+
+func (s *FileStateStore) Put(key string, value []byte) error {
+	if err := checkStateKey(key); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.Dir, key), sealState(value), 0644)
+}
+
+func (s *FileStateStore) Delete(key string) error {
+	if err := checkStateKey(key); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.Dir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MemoryStateStore keeps state for the life of the process only, ex: in
+// tests or on a read-only system.
+type MemoryStateStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{values: map[string][]byte{}}
+}
+
+func (s *MemoryStateStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		return nil, ErrStateNotFound
+	}
+	return bytes.Clone(v), nil
+}
+
+func (s *MemoryStateStore) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = map[string][]byte{}
+	}
+	s.values[key] = bytes.Clone(value)
+	return nil
+}
+
+func (s *MemoryStateStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+// nextCheck returns when the next update check is due. A damaged record
+// is reported and the check is due at once.
+func nextCheck(store StateStore, log Loggerr) time.Time {
+	p, err := store.Get(StateKeySchedule)
+	if errors.Is(err, ErrStateNotFound) {
+		return time.Time{}
+	}
+	if err == nil {
+		var t time.Time
+		if err = t.UnmarshalText(p); err == nil {
+			return t
+		}
+		err = fmt.Errorf("%s: %w: %v", StateKeySchedule, ErrStateCorrupt, err)
+	}
+	log.Log(zapcore.ErrorLevel, "reading the update schedule failed, checking now",
+		zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	return time.Time{}
+}
+
+func setNextCheck(store StateStore, t time.Time) error {
+	p, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	return store.Put(StateKeySchedule, p)
+}
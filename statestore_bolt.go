@@ -0,0 +1,74 @@
+//go:build unix || windows
+
+package opamppackagemgm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltStateBucket = []byte("opamp-state")
+
+// BoltStateStore keeps state in a single bbolt database file. Only one
+// process can have it open. It isn't built where bbolt lacks mmap and file
+// locks, ex: plan9.
+type BoltStateStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStateStore opens or creates the database at path, waiting up to
+// a second for another process to close it.
+func OpenBoltStateStore(path string) (*BoltStateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltStateBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStateStore{db: db}, nil
+}
+
+func (s *BoltStateStore) Get(key string) ([]byte, error) {
+	var sealed []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// the value is only valid inside the transaction
+		sealed = bytes.Clone(tx.Bucket(boltStateBucket).Get([]byte(key)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sealed == nil {
+		return nil, ErrStateNotFound
+	}
+	return unsealState(key, sealed)
+}
+
+func (s *BoltStateStore) Put(key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStateBucket).Put([]byte(key), sealState(value))
+	})
+}
+
+func (s *BoltStateStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStateBucket).Delete([]byte(key))
+	})
+}
+
+func (s *BoltStateStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,189 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throttleChunk bounds a single Read so that slow rates still produce a
+// steady stream instead of long bursts followed by long pauses.
+const throttleChunk = 32 * 1024
+
+// RateWindow applies Rate between Start and End, both measured from local
+// midnight. A window whose End is before its Start wraps past midnight.
+type RateWindow struct {
+	Start time.Duration
+	End   time.Duration
+	Rate  int64 // bytes per second, 0 means unlimited
+}
+
+func (w RateWindow) contains(t time.Time) bool {
+	y, m, d := t.Date()
+	offset := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// RateLimiter is a token bucket shared by every download it throttles. The
+// rate and the time-of-day schedule can be changed while downloads run.
+type RateLimiter struct {
+	mu       sync.Mutex
+	rate     int64
+	schedule []RateWindow
+	tokens   float64
+	last     time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSecond, 0 disables
+// the limit.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{rate: bytesPerSecond}
+}
+
+// SetRate changes the rate used outside of any scheduled window.
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bytesPerSecond
+}
+
+// SetSchedule replaces the time-of-day windows. The first window containing
+// the current time wins.
+func (l *RateLimiter) SetSchedule(windows []RateWindow) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.schedule = append([]RateWindow(nil), windows...)
+}
+
+// Rate returns the limit in effect at t.
+func (l *RateLimiter) Rate(t time.Time) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rateAt(t)
+}
+
+func (l *RateLimiter) rateAt(t time.Time) int64 {
+	for _, w := range l.schedule {
+		if w.contains(t) {
+			return w.Rate
+		}
+	}
+	return l.rate
+}
+
+// wait takes n tokens, sleeping off any debt. The bucket holds at most one
+// second worth of tokens.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	rate := float64(l.rateAt(now))
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		l.mu.Unlock()
+		return nil
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	return sleepContext(ctx, delay)
+}
+
+// ThrottledRequester limits the bandwidth of the bodies returned by the
+// wrapped Requester.
+type ThrottledRequester struct {
+	Requester
+	Limiter *RateLimiter
+}
+
+func NewThrottledRequester(r Requester, limiter *RateLimiter) *ThrottledRequester {
+	return &ThrottledRequester{Requester: r, Limiter: limiter}
+}
+
+func (t *ThrottledRequester) Fetch(url string) (io.ReadCloser, error) {
+	return t.FetchContext(context.Background(), url)
+}
+
+func (t *ThrottledRequester) FetchContext(ctx context.Context, url string) (io.ReadCloser, error) {
+	rc, err := WithContext(t.Requester).FetchContext(ctx, url)
+	if err != nil || rc == nil || t.Limiter == nil {
+		return rc, err
+	}
+	return &throttledReader{ctx: ctx, rc: rc, limiter: t.Limiter}, nil
+}
+
+// FetchRange throttles a range of the wrapped requester, which has to
+// support ranges.
+func (t *ThrottledRequester) FetchRange(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error) {
+	rr, ok := t.Requester.(RangeRequester)
+	if !ok {
+		return nil, fmt.Errorf("requester for %s does not support ranges", url)
+	}
+	rc, err := rr.FetchRange(ctx, url, offset, length)
+	if err != nil || rc == nil || t.Limiter == nil {
+		return rc, err
+	}
+	return &throttledReader{ctx: ctx, rc: rc, limiter: t.Limiter}, nil
+}
+
+func (t *ThrottledRequester) useHTTPClient(c *http.Client) bool {
+	return useHTTPClient(t.Requester, c)
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	rc      io.ReadCloser
+	limiter *RateLimiter
+}
+
+// idlePauser is implemented by bodies with an idle timeout. The time spent
+// sleeping off the rate limit isn't idle, at low rates a single chunk takes
+// longer than the timeout.
+type idlePauser interface {
+	pauseIdle()
+	resumeIdle()
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.rc.Read(p)
+	if n > 0 {
+		pauser, ok := r.rc.(idlePauser)
+		if ok {
+			pauser.pauseIdle()
+		}
+		werr := r.limiter.wait(r.ctx, n)
+		if ok {
+			pauser.resumeIdle()
+		}
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *throttledReader) Size() int64 {
+	return readerSize(r.rc)
+}
+
+func (r *throttledReader) Close() error {
+	return r.rc.Close()
+}
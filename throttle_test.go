@@ -0,0 +1,38 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Sleeping off the rate limit isn't idle: a chunk that takes longer than
+// the idle timeout to pay for must not abort the download.
+func TestThrottledDownloadOutlastsIdleTimeout(t *testing.T) {
+	body := bytes.Repeat([]byte{'x'}, 4096)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	httpRequester := NewHTTPRequester()
+	httpRequester.IdleTimeout = 100 * time.Millisecond
+	// 4 KiB at 8 KiB/s is a 500ms sleep
+	r := NewThrottledRequester(httpRequester, NewRateLimiter(8192))
+	rc, err := r.FetchContext(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("got %d bytes, want %d", len(got), len(body))
+	}
+}
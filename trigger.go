@@ -6,30 +6,96 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"go.uber.org/zap/zapcore"
 )
 
 const plat = runtime.GOOS + "-" + runtime.GOARCH // ex: linux-amd64
-const upcktimePath = "cktime"
 
 type TriggerUpdater interface {
 	Trigger(ctx context.Context) chan UpdatePackageInfo
 }
 
+// requesterUser is implemented by triggers that download their manifest.
+// The Updater hands them its Requester unless they have one already, so
+// manifest and artifact requests share the same authentication.
+type requesterUser interface {
+	useRequester(r Requester)
+}
+
+// The triggers keep their next update time through the functions below,
+// their Dir, CheckTimeDuration and Store fields are passed in.
+
+// legacySchedulePath is the file, Dir+"cktime" next to the executable, the
+// next update time was kept in before the StateStore.
+const legacySchedulePath = "cktime"
+
+func execRelativeDir(dir string) string {
+	filename, _ := os.Executable()
+	path := filepath.Join(filepath.Dir(filename), dir)
+	return path
+}
+
+func useScheduleStore(store *StateStore, s StateStore) {
+	if *store == nil {
+		*store = s
+	}
+}
+
+// scheduleStore returns store, or a FileStateStore in dir.
+func scheduleStore(store *StateStore, dir string) StateStore {
+	if *store == nil {
+		*store = NewFileStateStore(execRelativeDir(dir))
+	}
+	return *store
+}
+
+// nextUpdate returns when the next check is due. A time only found in the
+// legacy schedule file is moved to store.
+func nextUpdate(store StateStore, dir string, log Loggerr) time.Time {
+	if _, err := store.Get(StateKeySchedule); errors.Is(err, ErrStateNotFound) {
+		legacy := execRelativeDir(dir + legacySchedulePath)
+		if p, err := os.ReadFile(legacy); err == nil {
+			if t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(p))); err == nil && setNextCheck(store, t) == nil {
+				_ = os.Remove(legacy)
+				return t
+			}
+		}
+	}
+	return nextCheck(store, log)
+}
+
+// setUpdateTime writes the next update time, wait plus up to jitter from
+// now, to the state store.
+func setUpdateTime(store StateStore, wait, jitter time.Duration, log Loggerr) bool {
+	var waitrand time.Duration
+	if jitter > 0 {
+		waitrand = time.Duration(rand.Int63n(int64(jitter)))
+	}
+
+	if err := setNextCheck(store, time.Now().Add(wait+waitrand)); err != nil {
+		log.Log(zapcore.ErrorLevel, "writing the update schedule failed", zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		return false
+	}
+	return true
+}
+
 type RemoteFileCheckTrigger struct {
 	Dir               string        // store the next update time
 	ApiUrl            string        // the url to check for updates
 	BinURL            string        // the url to download the binary
 	CmdName           string        // the name of the command
 	CheckTimeDuration time.Duration // how often to check for updates
+	Requester         Requester     // Optional requester for the manifest, defaults to the updater's
+	Store             StateStore    // Optional store of the next update time, defaults to the updater's, or a FileStateStore in Dir
 	log               Loggerr
 }
 
@@ -60,17 +126,17 @@ func (f *RemoteFileCheckTrigger) Trigger(ctx context.Context) chan UpdatePackage
 			case <-ctx.Done():
 				return
 			case <-checkTick.C:
-				f.check(ch)
+				f.check(ctx, ch)
 			}
 		}
 	}()
 	return ch
 }
 
-func (f *RemoteFileCheckTrigger) check(ch chan UpdatePackageInfo) {
+func (f *RemoteFileCheckTrigger) check(ctx context.Context, ch chan UpdatePackageInfo) {
 	// check for updates
 	if f.NextUpdate().Before(time.Now()) {
-		info, err := f.getInfo()
+		info, err := f.getInfo(ctx)
 		if err != nil {
 			f.log.Log(zapcore.ErrorLevel, err.Error())
 			return
@@ -80,7 +146,14 @@ func (f *RemoteFileCheckTrigger) check(ch chan UpdatePackageInfo) {
 				Version:     info.Version,
 				ContentHash: info.Sha256,
 				IsPatch:     info.IsPatch,
-				DownloadUrl: fmt.Sprintf("%s/%s/%s/%s.gz", f.BinURL, f.CmdName, info.Version, plat),
+				DownloadUrl: fmt.Sprintf("%s/%s/%s/%s%s", f.BinURL, f.CmdName, info.Version, plat, artifactExt(info)),
+				Mirrors:     info.Mirrors,
+				Chunks:      info.Chunks,
+				Bundle:      info.Bundle,
+				Compression: info.Compression,
+				Patches:     info.Patches,
+				Hooks:       info.Hooks,
+				FileAttrs:   info.FileAttrs,
 				Signature:   nil,
 			}
 		}
@@ -94,18 +167,31 @@ func (f *RemoteFileCheckTrigger) check(ch chan UpdatePackageInfo) {
 	}
 }
 
-func (f *RemoteFileCheckTrigger) getInfo() (*Info, error) {
+// artifactExt is the file extension, including the dot, the artifact
+// described by info is published under.
+func artifactExt(info *Info) string {
+	if info.Bundle != nil {
+		return "." + info.Bundle.Format
+	}
+	return compressionExt(info.Compression)
+}
+
+func (f *RemoteFileCheckTrigger) useRequester(r Requester) {
+	if f.Requester == nil {
+		f.Requester = r
+	}
+}
+
+func (f *RemoteFileCheckTrigger) getInfo(ctx context.Context) (*Info, error) {
 	url := f.ApiUrl + "/" + url.QueryEscape(f.CmdName) + "/" + url.QueryEscape(plat) + ".json"
-	resp, err := http.Get(url)
+	body, err := f.fetch(ctx, url)
 	// get info
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("bad http status from %s: %v", url, resp.Status)
-	}
+	defer body.Close()
 	var u Info
-	err = json.NewDecoder(resp.Body).Decode(&u)
+	err = json.NewDecoder(body).Decode(&u)
 	if err != nil {
 		return nil, err
 	}
@@ -115,26 +201,31 @@ func (f *RemoteFileCheckTrigger) getInfo() (*Info, error) {
 	return &u, nil
 }
 
-func (f *RemoteFileCheckTrigger) getExecRelativeDir(dir string) string {
-	filename, _ := os.Executable()
-	path := filepath.Join(filepath.Dir(filename), dir)
-	return path
+// fetch requests the manifest at url until ctx is done. Without a
+// Requester the default HTTPRequester and its timeouts are used.
+func (f *RemoteFileCheckTrigger) fetch(ctx context.Context, url string) (io.ReadCloser, error) {
+	if f.Requester == nil {
+		return defaultHTTPRequester.FetchContext(ctx, url)
+	}
+	return WithContext(f.Requester).FetchContext(ctx, url)
+}
+
+func (f *RemoteFileCheckTrigger) useStore(s StateStore) {
+	useScheduleStore(&f.Store, s)
+}
+
+// store returns Store, or a FileStateStore in Dir.
+func (f *RemoteFileCheckTrigger) store() StateStore {
+	return scheduleStore(&f.Store, f.Dir)
 }
 
 func (f *RemoteFileCheckTrigger) NextUpdate() time.Time {
-	path := f.getExecRelativeDir(f.Dir + upcktimePath)
-	nextTime := readTime(path)
-	return nextTime
+	return nextUpdate(f.store(), f.Dir, f.log)
 }
 
-// SetUpdateTime writes the next update time to the state file
+// SetUpdateTime writes the next update time to the state store
 func (f *RemoteFileCheckTrigger) SetUpdateTime() bool {
-	path := f.getExecRelativeDir(f.Dir + upcktimePath)
-	wait := f.CheckTimeDuration
-	// Add 1 to random time since max is not included
-	waitrand := time.Duration(rand.Intn(3)) * time.Second
-
-	return writeTime(path, time.Now().Add(wait+waitrand))
+	return setUpdateTime(f.store(), f.CheckTimeDuration, 3*time.Second, f.log)
 }
 
 // json file example
@@ -152,6 +243,7 @@ type LocalFileCheckTrigger struct {
 	BinURL            string        // the url to download the binary
 	CmdName           string        // the name of the command
 	CheckTimeDuration time.Duration // how often to check for updates
+	Store             StateStore    // Optional store of the next update time, defaults to the updater's, or a FileStateStore in Dir
 	log               Loggerr
 }
 
@@ -206,6 +298,13 @@ func (f *LocalFileCheckTrigger) check(ch chan UpdatePackageInfo) {
 				ContentHash: info.ContentHash,
 				IsPatch:     info.IsPatch,
 				DownloadUrl: fmt.Sprintf("%s%s", f.BinURL, info.DownloadUrl),
+				Mirrors:     info.Mirrors,
+				Chunks:      info.Chunks,
+				Bundle:      info.Bundle,
+				Compression: info.Compression,
+				Patches:     info.Patches,
+				Hooks:       info.Hooks,
+				FileAttrs:   info.FileAttrs,
 				Signature:   nil,
 			}
 		}
@@ -240,24 +339,20 @@ func (f *LocalFileCheckTrigger) getInfo() (*UpdatePackageInfo, error) {
 	return u[f.CmdName], nil
 }
 
-func (f *LocalFileCheckTrigger) getExecRelativeDir(dir string) string {
-	filename, _ := os.Executable()
-	path := filepath.Join(filepath.Dir(filename), dir)
-	return path
+func (f *LocalFileCheckTrigger) useStore(s StateStore) {
+	useScheduleStore(&f.Store, s)
+}
+
+// store returns Store, or a FileStateStore in Dir.
+func (f *LocalFileCheckTrigger) store() StateStore {
+	return scheduleStore(&f.Store, f.Dir)
 }
 
 func (f *LocalFileCheckTrigger) NextUpdate() time.Time {
-	path := f.getExecRelativeDir(f.Dir + upcktimePath)
-	nextTime := readTime(path)
-	return nextTime
+	return nextUpdate(f.store(), f.Dir, f.log)
 }
 
-// SetUpdateTime writes the next update time to the state file
+// SetUpdateTime writes the next update time to the state store
 func (f *LocalFileCheckTrigger) SetUpdateTime() bool {
-	path := f.getExecRelativeDir(f.Dir + upcktimePath)
-	wait := f.CheckTimeDuration
-	// Add 1 to random time since max is not included
-	waitrand := time.Duration(rand.Intn(3600)) * time.Second
-
-	return writeTime(path, time.Now().Add(wait+waitrand))
+	return setUpdateTime(f.store(), f.CheckTimeDuration, time.Hour, f.log)
 }
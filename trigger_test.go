@@ -0,0 +1,168 @@
+package opamppackagemgm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// manifestAttrs is the policy the manifests of the tests below carry.
+var manifestAttrs = &FileAttrs{Mode: func() *uint32 { m := uint32(0o700); return &m }()}
+
+// checkOnce runs one check of a trigger and returns what it offered.
+func checkOnce(t *testing.T, check func(ctx context.Context, ch chan UpdatePackageInfo)) UpdatePackageInfo {
+	t.Helper()
+	ch := make(chan UpdatePackageInfo, 1)
+	check(context.Background(), ch)
+	select {
+	case info := <-ch:
+		return info
+	default:
+		t.Fatal("the trigger offered no update")
+		return UpdatePackageInfo{}
+	}
+}
+
+// assertPolicyApplied installs attributes the way the updater does and
+// checks the manifest's mode won over the one of the old executable.
+func assertPolicyApplied(t *testing.T, info UpdatePackageInfo) {
+	t.Helper()
+	if info.FileAttrs == nil {
+		t.Fatal("the offered update lost the manifest's file attributes")
+	}
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		return
+	}
+	dir := t.TempDir()
+	old, staged := filepath.Join(dir, "agent"), filepath.Join(dir, ".agent.new")
+	for _, p := range []string{old, staged} {
+		if err := os.WriteFile(p, []byte("agent"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := &Updater{Info: info, Logger: nopLog{}}
+	if err := u.attrPreparer(old)(staged); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0o700 {
+		t.Errorf("mode %#o, want the manifest's 0700", got)
+	}
+}
+
+func TestRemoteTriggerCarriesFileAttrs(t *testing.T) {
+	hash := sha256.Sum256([]byte("agent"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/agent/"+plat+".json" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(Info{Version: "1.1.0", Sha256: hash[:], FileAttrs: manifestAttrs})
+	}))
+	defer srv.Close()
+	f := NewRemoteFileCheckTrigger(srv.URL, srv.URL, "agent", "", 0, nopLog{}).(*RemoteFileCheckTrigger)
+	f.Store = NewMemoryStateStore()
+	assertPolicyApplied(t, checkOnce(t, f.check))
+}
+
+// plainRequester is a Requester without FetchContext.
+type plainRequester struct{}
+
+func (plainRequester) Fetch(url string) (io.ReadCloser, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (plainRequester) SetHeader(map[string]string) {}
+
+func TestRemoteTriggerFetchStopsWithContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a manifest server that never answers
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	for name, requester := range map[string]Requester{"default": nil, "context": NewHTTPRequester(), "plain": plainRequester{}} {
+		t.Run(name, func(t *testing.T) {
+			f := NewRemoteFileCheckTrigger(srv.URL, srv.URL, "agent", "", 0, nopLog{}).(*RemoteFileCheckTrigger)
+			f.Requester = requester
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if _, err := f.getInfo(ctx); err == nil {
+				t.Fatal("got a manifest from a server that never answered")
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("the fetch took %v after its context was done", d)
+			}
+		})
+	}
+}
+
+func TestLocalTriggerCarriesFileAttrs(t *testing.T) {
+	hash := sha256.Sum256([]byte("agent"))
+	manifest := filepath.Join(t.TempDir(), "manifest.json")
+	p, err := json.Marshal(map[string]UpdatePackageInfo{
+		"agent": {Version: "1.1.0", ContentHash: hash[:], DownloadUrl: "/agent", FileAttrs: manifestAttrs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(manifest, p, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := NewLocalFileCheckTrigger(manifest, "http://example.invalid", "agent", "", 0, nopLog{}).(*LocalFileCheckTrigger)
+	f.Store = NewMemoryStateStore()
+	assertPolicyApplied(t, checkOnce(t, func(_ context.Context, ch chan UpdatePackageInfo) { f.check(ch) }))
+}
+
+func TestNextUpdateMigratesLegacySchedule(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	rel, err := filepath.Rel(filepath.Dir(exe), dir)
+	if err != nil {
+		t.Skip("the temp dir can't be reached from the test binary's")
+	}
+	want := time.Now().Add(time.Hour).Truncate(time.Second)
+	legacy := filepath.Join(dir, legacySchedulePath)
+	if err := os.WriteFile(legacy, []byte(want.Format(time.RFC3339)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &LocalFileCheckTrigger{
+		Dir:               rel + string(filepath.Separator),
+		CheckTimeDuration: time.Minute,
+		Store:             NewMemoryStateStore(),
+		log:               nopLog{},
+	}
+	if got := f.NextUpdate(); !got.Equal(want) {
+		t.Errorf("next update %v, want the legacy %v", got, want)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("legacy schedule left behind: %v", err)
+	}
+	if got := nextCheck(f.Store, nopLog{}); !got.Equal(want) {
+		t.Errorf("store holds %v, want %v", got, want)
+	}
+}
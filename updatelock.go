@@ -0,0 +1,163 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	updateLockPath = "update.lock"
+	// lockPollInterval is how often a waiting updater tries the lock again.
+	lockPollInterval = 500 * time.Millisecond
+)
+
+// LockMode tells what Update does while another updater of the same
+// executable holds the update lock.
+type LockMode int
+
+const (
+	LockWait LockMode = iota // wait until it is done, or the context is cancelled
+	LockSkip                 // leave the update to it and return nil
+	LockFail                 // return ErrUpdateLocked
+)
+
+var ErrUpdateLocked = errors.New("another updater is installing an update")
+
+// updateLock is the held lock on update.lock in Dir.
+type updateLock struct {
+	fp *os.File
+}
+
+// lockUpdate takes the update lock, so that two updaters, ex: the agent's
+// background updater and a manual run, never swap the same files at once.
+//
+// The lock is an flock, released by the kernel when its holder dies. The
+// holder writes its pid into the file; a lock that is held although that
+// process is gone, ex: by a child that inherited the descriptor, is stale
+// and broken by replacing the file.
+func (u *Updater) lockUpdate(ctx context.Context) (*updateLock, error) {
+	return u.lockUpdateMode(ctx, u.LockMode)
+}
+
+// lockUpdateMode is lockUpdate waiting for the lock only in LockWait mode.
+func (u *Updater) lockUpdateMode(ctx context.Context, mode LockMode) (*updateLock, error) {
+	path := filepath.Join(u.getExecRelativeDir(u.Dir), updateLockPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	logged := false
+	for {
+		l, err := tryLockUpdate(path)
+		if err == nil {
+			return l, nil
+		}
+		if !errors.Is(err, errLockHeld) {
+			return nil, err
+		}
+		pid, broken, err := breakStaleLock(path)
+		if err != nil {
+			return nil, err
+		}
+		if broken {
+			u.logger().Log(zapcore.WarnLevel, "update: broke a stale update lock",
+				zapcore.Field{Key: "pid", Type: zapcore.Int64Type, Integer: int64(pid)})
+			continue
+		}
+		if mode != LockWait {
+			return nil, fmt.Errorf("%w (pid %d)", ErrUpdateLocked, pid)
+		}
+		if !logged {
+			u.logger().Log(zapcore.InfoLevel, "update: waiting for another updater",
+				zapcore.Field{Key: "pid", Type: zapcore.Int64Type, Integer: int64(pid)})
+			logged = true
+		}
+		if err := sleepContext(ctx, lockPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// tryLockUpdate takes the lock on path without waiting and records the
+// pid of this process in it.
+func tryLockUpdate(path string) (*updateLock, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(fp, true, true); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	// a stale lock broken meanwhile leaves us holding the removed file
+	held, err1 := fp.Stat()
+	current, err2 := os.Stat(path)
+	if err1 != nil || err2 != nil || !os.SameFile(held, current) {
+		unlockFile(fp)
+		fp.Close()
+		return nil, errLockHeld
+	}
+	if err := fp.Truncate(0); err != nil {
+		unlockFile(fp)
+		fp.Close()
+		return nil, err
+	}
+	if _, err := fp.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		unlockFile(fp)
+		fp.Close()
+		return nil, err
+	}
+	return &updateLock{fp: fp}, nil
+}
+
+// breakStaleLock removes the lock file at path if the process recorded in
+// it is gone. It returns the recorded pid. Breakers take turns on a lock of
+// their own, so a lock file is only ever removed by the one that found it
+// stale, never after a live updater has replaced it.
+func breakStaleLock(path string) (int, bool, error) {
+	fp, err := os.OpenFile(path+".break", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, false, err
+	}
+	defer fp.Close()
+	if err := lockFile(fp, true, false); err != nil {
+		return 0, false, err
+	}
+	defer unlockFile(fp)
+	pid, alive := lockHolder(path)
+	if alive {
+		return pid, false, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return pid, false, err
+	}
+	return pid, true, nil
+}
+
+// lockHolder returns the pid recorded in the lock file and whether that
+// process is alive. A pid that can't be read is taken to be alive, the
+// holder may not have written it yet.
+func lockHolder(path string) (int, bool) {
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return 0, true
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(p)))
+	if err != nil || pid <= 0 {
+		return 0, true
+	}
+	return pid, pid == os.Getpid() || processAlive(pid)
+}
+
+func (l *updateLock) unlock() {
+	_ = l.fp.Truncate(0)
+	_ = unlockFile(l.fp)
+	_ = l.fp.Close()
+}
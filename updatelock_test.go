@@ -0,0 +1,313 @@
+package opamppackagemgm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// The lock tests contend from processes of their own: the test binary is
+// run again with lockHelperEnv set and TestLockHelperProcess does one of
+// the steps below instead of testing.
+const lockHelperEnv = "OPAMP_LOCK_HELPER"
+
+type nopLog struct{}
+
+func (nopLog) Log(zapcore.Level, string, ...zapcore.Field) {}
+
+func lockTestUpdater(dir string, mode LockMode) *Updater {
+	return &Updater{
+		ExecutablePath: filepath.Join(dir, "agent"),
+		Dir:            "state",
+		LockMode:       mode,
+		Logger:         nopLog{},
+		Store:          NewMemoryStateStore(),
+	}
+}
+
+// TestLockHelperProcess is the body of the helper processes. It prints
+// "result: <outcome>" and exits.
+func TestLockHelperProcess(t *testing.T) {
+	step := os.Getenv(lockHelperEnv)
+	if step == "" {
+		t.Skip("only run as a helper process")
+	}
+	dir := os.Getenv("OPAMP_LOCK_DIR")
+	mode, _ := strconv.Atoi(os.Getenv("OPAMP_LOCK_MODE"))
+	u := lockTestUpdater(dir, LockMode(mode))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result := ""
+	switch step {
+	case "lock":
+		lock, err := u.lockUpdate(ctx)
+		if err != nil {
+			result = lockOutcome(err)
+			break
+		}
+		// a second holder at once fails to create the marker
+		marker := filepath.Join(dir, "held")
+		fp, err := os.OpenFile(marker, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			result = "overlap"
+			lock.unlock()
+			break
+		}
+		fp.Close()
+		time.Sleep(100 * time.Millisecond)
+		os.Remove(marker)
+		lock.unlock()
+		result = "locked"
+	case "update":
+		u.CurrentVersion = "1.0.0"
+		u.Info = UpdatePackageInfo{Version: "1.1.0"}
+		if err := u.Update(); err != nil {
+			result = lockOutcome(err)
+		} else {
+			result = "skipped"
+		}
+	case "exit":
+	}
+	fmt.Println("result: " + result)
+	os.Exit(0)
+}
+
+func lockOutcome(err error) string {
+	if errors.Is(err, ErrUpdateLocked) {
+		return "locked-out"
+	}
+	return "error " + err.Error()
+}
+
+// runLockHelpers runs n helper processes doing step at once and returns
+// their outcomes.
+func runLockHelpers(t *testing.T, dir, step string, mode LockMode, n int) []string {
+	t.Helper()
+	out := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := lockHelperCmd(dir, step, mode)
+			b, err := cmd.Output()
+			if err != nil {
+				out[i] = "error " + err.Error()
+				return
+			}
+			out[i] = parseLockResult(b)
+		}(i)
+	}
+	wg.Wait()
+	return out
+}
+
+func lockHelperCmd(dir, step string, mode LockMode) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	cmd.Env = append(os.Environ(),
+		lockHelperEnv+"="+step,
+		"OPAMP_LOCK_DIR="+dir,
+		"OPAMP_LOCK_MODE="+strconv.Itoa(int(mode)),
+	)
+	return cmd
+}
+
+func parseLockResult(b []byte) string {
+	for _, line := range strings.Split(string(b), "\n") {
+		if r, ok := strings.CutPrefix(line, "result: "); ok {
+			return r
+		}
+	}
+	return "no result in " + string(bytes.TrimSpace(b))
+}
+
+func skipWithoutLocks(t *testing.T) {
+	if runtime.GOOS == "plan9" || runtime.GOOS == "js" || runtime.GOOS == "wasip1" {
+		t.Skip("no advisory locks on " + runtime.GOOS)
+	}
+}
+
+// skipWithoutInProcessLocks skips tests taking the lock twice in one
+// process, fcntl locks don't exclude the process holding them.
+func skipWithoutInProcessLocks(t *testing.T) {
+	skipWithoutLocks(t)
+	if runtime.GOOS == "solaris" || runtime.GOOS == "illumos" || runtime.GOOS == "aix" {
+		t.Skip("fcntl locks are per process on " + runtime.GOOS)
+	}
+}
+
+func TestLockUpdateWait(t *testing.T) {
+	skipWithoutLocks(t)
+	dir := t.TempDir()
+	for i, r := range runLockHelpers(t, dir, "lock", LockWait, 6) {
+		if r != "locked" {
+			t.Errorf("helper %d: got %q, want locked", i, r)
+		}
+	}
+}
+
+// holdLock takes the update lock in this process for the length of the
+// test.
+func holdLock(t *testing.T, dir string) {
+	t.Helper()
+	lock, err := lockTestUpdater(dir, LockFail).lockUpdate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lock.unlock)
+}
+
+func TestLockUpdateFail(t *testing.T) {
+	skipWithoutLocks(t)
+	dir := t.TempDir()
+	holdLock(t, dir)
+	for i, r := range runLockHelpers(t, dir, "lock", LockFail, 4) {
+		if r != "locked-out" {
+			t.Errorf("helper %d: got %q, want locked-out", i, r)
+		}
+	}
+}
+
+func TestLockUpdateSkip(t *testing.T) {
+	skipWithoutLocks(t)
+	dir := t.TempDir()
+	holdLock(t, dir)
+	for i, r := range runLockHelpers(t, dir, "update", LockSkip, 4) {
+		if r != "skipped" {
+			t.Errorf("helper %d: got %q, want skipped", i, r)
+		}
+	}
+}
+
+// A lock still held, ex: by a descriptor a child inherited, after the pid
+// in it has exited is broken by the next updater.
+func TestLockUpdateBreaksStaleLock(t *testing.T) {
+	skipWithoutLocks(t)
+	dir := t.TempDir()
+	exited := lockHelperCmd(dir, "exit", LockFail)
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	deadPid := exited.Process.Pid
+
+	path := filepath.Join(dir, "state", updateLockPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if err := lockFile(fp, true, true); err != nil {
+		t.Fatal(err)
+	}
+	defer unlockFile(fp)
+	if _, err := fp.WriteString(strconv.Itoa(deadPid) + "\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	locked := 0
+	for i, r := range runLockHelpers(t, dir, "lock", LockFail, 3) {
+		// the first to break the lock holds it, the others may find it held
+		switch r {
+		case "locked":
+			locked++
+		case "locked-out":
+		default:
+			t.Errorf("helper %d: got %q, want locked or locked-out", i, r)
+		}
+	}
+	if locked == 0 {
+		t.Error("no helper broke the stale lock")
+	}
+	if r := runLockHelpers(t, dir, "lock", LockFail, 1)[0]; r != "locked" {
+		t.Errorf("after the break: got %q, want locked", r)
+	}
+}
+
+// A swapped update resumed while another updater holds the lock is read
+// again once the lock is free: confirmed meanwhile, it is left alone.
+func TestResumeRereadsRecordUnderLock(t *testing.T) {
+	skipWithoutInProcessLocks(t)
+	dir := t.TempDir()
+	u := lockTestUpdater(dir, LockWait)
+	u.CurrentVersion = "1.1.0"
+	rec := &updateRecord{
+		State:      StateSwapped,
+		From:       "1.0.0",
+		Info:       UpdatePackageInfo{Version: "1.1.0"},
+		Executable: u.ExecutablePath,
+		Target:     u.ExecutablePath,
+	}
+	if err := u.saveUpdateRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+	holder, err := u.lockUpdate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- u.resume() }()
+	time.Sleep(lockPollInterval)
+	// the holder confirms the update and lets go
+	rec.State = StateConfirmed
+	if err := u.saveUpdateRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+	holder.unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := u.History(); len(entries) != 0 {
+		t.Errorf("resume ran the post-install again: %+v", entries)
+	}
+	if state, _ := u.UpdateState(); state != StateConfirmed {
+		t.Errorf("state %q, want confirmed", state)
+	}
+}
+
+// The staged files of an install in progress look like the leftovers of an
+// interrupted one, recovery leaves them alone while the lock is held.
+func TestRecoverSkipsWhileLocked(t *testing.T) {
+	skipWithoutInProcessLocks(t)
+	dir := t.TempDir()
+	u := lockTestUpdater(dir, LockWait)
+	newPath, oldPath := stagingPaths(u.ExecutablePath)
+	for _, p := range []string{u.ExecutablePath, newPath, oldPath} {
+		if err := os.WriteFile(p, []byte(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	holder, err := u.lockUpdate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.recoverInterrupted()
+	for _, p := range []string{newPath, oldPath} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("recovery touched %s of a running install: %v", filepath.Base(p), err)
+		}
+	}
+	holder.unlock()
+
+	u.recoverInterrupted()
+	for _, p := range []string{newPath, oldPath} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after recovery: %v", filepath.Base(p), err)
+		}
+	}
+}
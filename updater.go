@@ -2,16 +2,18 @@ package opamppackagemgm
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
-	"github.com/kr/binarydist"
+	"go.uber.org/zap/zapcore"
 )
 
 type Updater struct {
@@ -24,7 +26,26 @@ type Updater struct {
 	Info               UpdatePackageInfo     // Info about the update
 	OnSuccessfulUpdate func(context.Context) // Optional function to run after an update has successfully taken place
 	OnFailedUpdate     func(context.Context) // Optional function to run after an update has failed
-	IsGzipped          bool                  // Optional parameter to specify if the binary is gzipped
+	IsGzipped          bool                  // Deprecated: compression is taken from Info.Compression or recognised from the artifact
+	Retry              *RetryPolicy          // Optional parameter to override DefaultRetryPolicy
+	OnProgress         func(Progress)        // Optional function receiving download progress
+	Cache              *ArtifactCache        // Optional cache of verified binaries and patches, consulted before any download
+	AttrBestEffort     bool                  // Optional, log attributes of the old executable that can't be reproduced instead of failing the update
+	DryRun             bool                  // Optional, go through offered updates without installing them, see DryRunUpdate
+	OnDryRun           func(*DryRunReport)   // Optional receiver of dry run reports, they are logged otherwise
+	BundleDir          string                // Optional directory bundle updates are extracted to and swapped in as a whole, relative to the executable unless absolute; required when Info names a Bundle outside of slot installs
+	ExecutablePath     string                // Optional path of the executable to update, defaults to the running one
+	SlotsDir           string                // Optional directory of A/B slots, see SlotA; when set updates are installed to the inactive slot and Dir is relative to it
+	ChunkConcurrency   int                   // Optional number of parallel ranges when Info lists chunks, defaults to DefaultChunkConcurrency
+	HistoryMaxBytes    int64                 // Optional size at which the history journal in Dir is rotated, defaults to DefaultHistoryMaxBytes; negative disables the journal
+	HistoryMaxFiles    int                   // Optional number of rotated journals kept, defaults to DefaultHistoryMaxFiles; negative keeps none
+	Store              StateStore            // Optional store of the schedule, mirror backoff and update progress, defaults to a FileStateStore in Dir
+	LockMode           LockMode              // Optional behaviour while another updater of the executable is installing, defaults to LockWait
+
+	healthOnce sync.Once
+	health     *mirrorHealthStore
+	historyMu  sync.Mutex
+	inFlight   *updateRecord
 }
 
 // BackgroundRun 开始更新检查和应用周期。
@@ -43,65 +64,194 @@ func (u *Updater) BackgroundRun() error {
 	if u.Requester == nil {
 		u.Requester = defaultHTTPRequester
 	}
+	if !u.DryRun {
+		// before the leftovers are cleaned up, a swapped update still needs its previous version
+		if err := u.resume(); err != nil {
+			u.logger().Log(zapcore.WarnLevel, "update: resuming an interrupted update failed",
+				zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		}
+		u.recoverInterrupted()
+	}
+	if t, ok := u.Trigger.(requesterUser); ok {
+		t.useRequester(u.Requester)
+	}
+	if t, ok := u.Trigger.(stateUser); ok {
+		t.useStore(u.store())
+	}
 	for {
 		select {
 		case info := <-u.WantUpdate():
 			u.Info = info
-			if err := canUpdate(); err != nil {
+			if u.DryRun {
+				u.dryRun()
+				continue
+			}
+			if err := u.canUpdate(); err != nil {
 				// fail
 				return err
 			}
-			if err := u.Update(); err != nil {
+			if err := u.Update(); err != nil && !errors.Is(err, ErrUpdateBlocked) {
 				return err
 			}
-		case <-u.ctx.Done():
+		case <-u.context().Done():
 			return nil
 		}
 	}
 }
 
+// recoverInterrupted cleans up after an install interrupted by a crash. The
+// leftovers of an install another updater is running right now look the
+// same, so nothing is touched while the update lock is held.
+func (u *Updater) recoverInterrupted() {
+	lock, err := u.lockUpdateMode(u.context(), LockFail)
+	if err != nil {
+		level := zapcore.WarnLevel
+		if errors.Is(err, ErrUpdateLocked) {
+			level = zapcore.InfoLevel
+		}
+		u.logger().Log(level, "update: skipping the recovery of interrupted installs",
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		return
+	}
+	defer lock.unlock()
+	if u.SlotsDir != "" {
+		if err := u.recoverSlots(); err != nil {
+			u.logger().Log(zapcore.WarnLevel, "update: recovering an interrupted slot switch failed",
+				zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		}
+	} else if path, err := u.executable(); err == nil {
+		if err := recoverInstall(path); err != nil {
+			u.logger().Log(zapcore.WarnLevel, "update: recovering an interrupted install failed",
+				zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		}
+	}
+	if u.BundleDir != "" && u.SlotsDir == "" {
+		if err := recoverInstall(u.bundleDir()); err != nil {
+			u.logger().Log(zapcore.WarnLevel, "update: recovering an interrupted bundle install failed",
+				zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		}
+	}
+}
+
 func (u *Updater) WantUpdate() chan UpdatePackageInfo {
-	return u.Trigger.Trigger(u.ctx)
+	return u.Trigger.Trigger(u.context())
+}
+
+// logger returns the configured Logger or a default one.
+func (u *Updater) logger() Loggerr {
+	if u.Logger == nil {
+		u.Logger = NewLog()
+	}
+	return u.Logger
+}
+
+// store returns Store, or a FileStateStore in Dir.
+func (u *Updater) store() StateStore {
+	if u.Store == nil {
+		u.Store = NewFileStateStore(u.getExecRelativeDir(u.Dir))
+	}
+	return u.Store
+}
+
+// context returns the updater's context, falling back to Background for
+// updaters built without NewUpdater.
+func (u *Updater) context() context.Context {
+	if u.ctx == nil {
+		return context.Background()
+	}
+	return u.ctx
 }
 
 // canUpdate 检查更新条件是否满足。
-func canUpdate() (err error) {
+func (u *Updater) canUpdate() (err error) {
 	// get the directory the file exists in
-	path, err := os.Executable()
+	path, err := u.executable()
 	if err != nil {
 		return
 	}
 
 	fileDir := filepath.Dir(path)
 	fileName := filepath.Base(path)
+	if u.SlotsDir != "" {
+		// only the slots directory is written to
+		fileDir = u.SlotsDir
+	}
 
 	// 尝试打开文件目录中的文件
-	newPath := filepath.Join(fileDir, fmt.Sprintf(".%s.new", fileName))
-	fp, err := os.OpenFile(newPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	// a file of its own, .name.new may be staged by another updater
+	fp, err := os.CreateTemp(fileDir, fmt.Sprintf(".%s.probe-*", fileName))
 	if err != nil {
 		return
 	}
 	fp.Close()
 
-	_ = os.Remove(newPath)
+	_ = os.Remove(fp.Name())
 	return
 }
 
-// Update initiates the self update process
+// Update initiates the self update process. Cancelling the updater's
+// context aborts any download in flight. Every attempt is recorded in the
+// history journal, see History, and its progress is persisted, see
+// UpdateState. Only one updater of the executable installs at a time, see
+// LockMode. An offer ruled out by a pin fails with a *BlockedError.
 func (u *Updater) Update() error {
-	path, err := os.Executable()
+	if u.DryRun {
+		u.dryRun()
+		return nil
+	}
+	// we are on the latest version, nothing to do
+	if u.Info.Version == u.CurrentVersion {
+		return nil
+	}
+	if err := u.checkPins(u.Info.Version); err != nil {
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			u.blocked(blocked)
+		}
+		return err
+	}
+	waited := time.Now()
+	lock, err := u.lockUpdate(u.context())
+	if errors.Is(err, ErrUpdateLocked) && u.LockMode == LockSkip {
+		u.logger().Log(zapcore.InfoLevel, "update: skipped, another updater is installing",
+			zapcore.Field{Key: "version", Type: zapcore.StringType, String: u.Info.Version},
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	defer lock.unlock()
+	// the other updater may have installed it while we waited; an older
+	// record doesn't count, the version may have been rolled back since
+	if rec, _ := u.loadUpdateRecord(); rec != nil && rec.State == StateConfirmed && rec.Changed.After(waited) &&
+		rec.From == u.CurrentVersion && rec.Info.Version == u.Info.Version {
+		return nil
+	}
 
-	if resolvedPath, err := filepath.EvalSymlinks(path); err == nil {
-		path = resolvedPath
+	e := HistoryEntry{Time: time.Now(), From: u.CurrentVersion, To: u.Info.Version, Outcome: OutcomeSucceeded}
+	u.begin()
+	err = u.update(&e)
+	u.end(err)
+	e.Duration = time.Since(e.Time)
+	if err != nil {
+		if e.Outcome == OutcomeSucceeded {
+			e.Outcome = OutcomeFailed
+		}
+		e.Error = err.Error()
 	}
+	u.record(e)
+	return err
+}
 
-	// we are on the latest version, nothing to do
-	if u.Info.Version == u.CurrentVersion {
-		return nil
+// update does the work of Update, filling in e as it goes.
+func (u *Updater) update(e *HistoryEntry) error {
+	ctx := u.context()
+	path, err := u.executable()
+	if err != nil {
+		return err
 	}
+	u.inFlight.Executable = path
 
 	old, err := os.Open(path)
 	if err != nil {
@@ -109,113 +259,271 @@ func (u *Updater) Update() error {
 	}
 	defer old.Close()
 
-	bin, err := u.fetchAndVerifyPatch(old)
+	u.advance(StateDownloading)
+	bin, err := u.fetchCounted(ctx, old, &e.Source, &e.Bytes)
 	if err != nil {
-		if err == ErrHashMismatch {
-			log.Println("update: hash mismatch from patched binary")
-		}
-
-		// if patch failed grab the full new bin
-		bin, err = u.fetchAndVerifyFullBin()
-		if err != nil {
-			if err == ErrHashMismatch {
-				log.Println("update: hash mismatch from full binary")
-			} else {
-				log.Println("update: fetching full binary,", err)
-			}
-			return err
-		}
+		return err
 	}
+	u.advance(StateDownloaded)
 	// close the old binary before installing because on windows
 	// it can't be renamed if a handle to the file is still open
 	old.Close()
-
-	err, errRecover := fromStream(bytes.NewBuffer(bin))
+	// every source verifies, this is the check the verified state stands for
+	if !verifySha(bin, u.Info.ContentHash) {
+		return ErrHashMismatch
+	}
+	u.publish(bin)
+	u.advance(StateVerified)
+
+	var errRecover error
+	target := path
+	switch {
+	case u.SlotsDir != "":
+		target, err = u.installSlot(ctx, path, bin)
+	case u.Info.Bundle != nil:
+		target = u.bundleDir()
+		err, errRecover = u.installBundle(ctx, path, bin)
+	default:
+		if err := u.runHook(ctx, HookPreInstall, filepath.Dir(path), path); err != nil {
+			return err
+		}
+		prepare := u.attrPreparer(path)
+		err, errRecover = fromStream(path, bytes.NewBuffer(bin), func(newPath string) error {
+			if err := prepare(newPath); err != nil {
+				return err
+			}
+			u.stage(path)
+			return nil
+		})
+	}
 	if errRecover != nil {
 		return fmt.Errorf("update and recovery errors: %q %q", err, errRecover)
 	}
 	if err != nil {
 		return err
 	}
+	u.advance(StateSwapped)
+	if err := u.postInstall(ctx, path, target); err != nil {
+		e.Outcome = OutcomeRolledBack
+		return err
+	}
 
 	// update was successful, run func if set
 	if u.OnSuccessfulUpdate != nil {
-		u.OnSuccessfulUpdate(u.ctx)
+		u.OnSuccessfulUpdate(ctx)
 	}
 
 	return nil
 }
 
-func fromStream(updateWith io.Reader) (err error, errRecover error) {
-	updatePath, err := os.Executable()
-	if err != nil {
-		return
-	}
-
+// fromStream replaces the executable at updatePath with the content of
+// updateWith. The platform specific installBinary does the swap, prepare
+// may adjust the staged file before it is swapped in.
+func fromStream(updatePath string, updateWith io.Reader, prepare func(newPath string) error) (err error, errRecover error) {
 	var newBytes []byte
 	newBytes, err = ioutil.ReadAll(updateWith)
 	if err != nil {
 		return
 	}
+	return installBinary(updatePath, newBytes, prepare)
+}
 
-	// get the directory the executable exists in
-	updateDir := filepath.Dir(updatePath)
-	filename := filepath.Base(updatePath)
-
-	// Copy the contents of of newbinary to a the new executable file
-	newPath := filepath.Join(updateDir, fmt.Sprintf(".%s.new", filename))
-	fp, err := os.OpenFile(newPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+// writeSynced writes data to path, runs prepare on it if set and fsyncs
+// it before returning.
+func writeSynced(path string, data []byte, perm os.FileMode, prepare func(path string) error) error {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
 	if err != nil {
-		return
+		return err
 	}
-	defer fp.Close()
-	_, err = io.Copy(fp, bytes.NewReader(newBytes))
-
-	// if we don't call fp.Close(), windows won't let us move the new executable
-	// because the file will still be "in use"
-	fp.Close()
-
-	// this is where we'll move the executable to so that we can swap in the updated replacement
-	oldPath := filepath.Join(updateDir, fmt.Sprintf(".%s.old", filename))
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if prepare != nil {
+		if err := prepare(path); err != nil {
+			fp.Close()
+			return err
+		}
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
 
-	// delete any existing old exec file - this is necessary on Windows for two reasons:
-	// 1. after a successful update, Windows can't remove the .old file because the process is still running
-	// 2. windows rename operations fail if the destination file already exists
-	_ = os.Remove(oldPath)
+// stagingPaths returns the .name.new and .name.old paths next to path.
+func stagingPaths(path string) (newPath, oldPath string) {
+	dir := filepath.Dir(path)
+	name := filepath.Base(path)
+	return filepath.Join(dir, fmt.Sprintf(".%s.new", name)), filepath.Join(dir, fmt.Sprintf(".%s.old", name))
+}
 
-	// move the existing executable to a new file in the same directory
-	err = os.Rename(updatePath, oldPath)
-	if err != nil {
-		return
+// recoverInstall cleans up after an install that was interrupted, e.g. by
+// a power cut. If the executable is missing it is restored from the
+// leftover .old (the previous version) or .new (the fully written
+// update); otherwise the leftovers are removed. It works the same for a
+// bundle directory.
+func recoverInstall(path string) error {
+	newPath, oldPath := stagingPaths(path)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		for _, candidate := range []string{oldPath, newPath} {
+			if _, err := os.Stat(candidate); err == nil {
+				if err := os.Rename(candidate, path); err != nil {
+					return err
+				}
+				syncDir(filepath.Dir(path))
+				break
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+	_ = os.RemoveAll(newPath)
+	if err := os.RemoveAll(oldPath); err != nil {
+		// windows can't remove the .old of a binary that is still running
+		_ = hideFile(oldPath)
 	}
+	return nil
+}
 
-	// move the new exectuable in to become the new program
-	err = os.Rename(newPath, updatePath)
+// finishInstall drops the previous version kept at .name.old once the
+// update at path is confirmed.
+func finishInstall(path string) error {
+	_, oldPath := stagingPaths(path)
+	if err := os.RemoveAll(oldPath); err != nil {
+		// windows can't remove the .old of a binary that is still running
+		_ = hideFile(oldPath)
+	}
+	return syncDir(filepath.Dir(path))
+}
 
-	if err != nil {
-		// copy unsuccessful
-		errRecover = os.Rename(oldPath, updatePath)
-	} else {
-		// copy successful, remove the old binary
-		errRemove := os.Remove(oldPath)
-
-		// windows has trouble with removing old binaries, so hide it instead
-		if errRemove != nil {
-			_ = hideFile(oldPath)
+// rollbackInstall puts the previous version kept at .name.old back at
+// path. The rejected update is moved to .name.new.
+func rollbackInstall(path string) error {
+	newPath, oldPath := stagingPaths(path)
+	if _, err := os.Lstat(oldPath); err != nil {
+		return err
+	}
+	_ = os.RemoveAll(newPath)
+	if err := os.Rename(path, newPath); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, path); err != nil {
+		if errRecover := os.Rename(newPath, path); errRecover != nil {
+			return fmt.Errorf("%v, and restoring the update failed: %v", err, errRecover)
 		}
+		return err
 	}
+	return syncDir(filepath.Dir(path))
+}
 
-	return
+// executable returns the path of the binary to update, ExecutablePath or
+// the running one, with symlinks resolved. Under SlotsDir that is the
+// binary in the active slot.
+func (u *Updater) executable() (string, error) {
+	path := u.ExecutablePath
+	if path == "" {
+		var err error
+		if path, err = os.Executable(); err != nil {
+			return "", err
+		}
+	}
+	if resolvedPath, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolvedPath
+	}
+	return path, nil
 }
 
 func (u *Updater) getExecRelativeDir(dir string) string {
-	filename, _ := os.Executable()
+	if u.SlotsDir != "" {
+		// the executable's own directory changes with every update
+		return filepath.Join(u.SlotsDir, dir)
+	}
+	filename := u.ExecutablePath
+	if filename == "" {
+		filename, _ = os.Executable()
+	}
 	path := filepath.Join(filepath.Dir(filename), dir)
 	return path
 }
 
-func (u *Updater) fetchAndVerifyPatch(old io.Reader) ([]byte, error) {
-	bin, err := u.fetchAndApplyPatch(old)
+// Where fetchVerified found the update.
+const (
+	sourceCache = "cache"
+	sourcePeer  = "peer"
+	sourcePatch = "patch"
+	sourceFull  = "full"
+)
+
+// fetchVerified returns the verified new binary from the cheapest source:
+// LAN peers first, then a patch against old, then the full binary. The
+// source it came from is returned alongside, the progress of the downloads
+// goes to onProgress.
+func (u *Updater) fetchVerified(ctx context.Context, old io.Reader, onProgress func(Progress)) ([]byte, string, error) {
+	if u.Cache != nil {
+		if bin, err := u.Cache.Get(u.Info.ContentHash); err == nil {
+			return bin, sourceCache, nil
+		}
+	}
+	if bin, err := u.fetchFromPeers(ctx); err == nil {
+		return bin, sourcePeer, nil
+	}
+	if ctx.Err() != nil {
+		return nil, "", ctx.Err()
+	}
+
+	// patches apply to the running executable, never to a bundle
+	if u.Info.Bundle == nil {
+		bin, err := u.fetchAndVerifyPatch(ctx, old, onProgress)
+		if err == nil {
+			return bin, sourcePatch, nil
+		}
+		if err == ErrHashMismatch {
+			u.logger().Log(zapcore.WarnLevel, "update: hash mismatch from patched binary")
+		}
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+	}
+
+	// if patch failed grab the full new bin
+	bin, err := u.fetchAndVerifyFullBin(ctx, onProgress)
+	if err != nil {
+		if err == ErrHashMismatch {
+			u.logger().Log(zapcore.ErrorLevel, "update: hash mismatch from full binary")
+		} else {
+			u.logger().Log(zapcore.ErrorLevel, "update: fetching full binary failed",
+				zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		}
+		return nil, "", err
+	}
+	return bin, sourceFull, nil
+}
+
+// fetchCounted is fetchVerified that also reports the source and the bytes
+// downloaded, tallied from the progress passed on to OnProgress.
+func (u *Updater) fetchCounted(ctx context.Context, old io.Reader, source *string, downloaded *int64) ([]byte, error) {
+	tally := &byteTally{last: map[string]int64{}}
+	onProgress := u.OnProgress
+	bin, src, err := u.fetchVerified(ctx, old, func(p Progress) {
+		tally.add(p)
+		if onProgress != nil {
+			onProgress(p)
+		}
+	})
+	*source, *downloaded = src, tally.total
+	return bin, err
+}
+
+// fetchFromPeers asks the requester for the binary by content hash if it
+// knows how to, see PeerRequester.
+func (u *Updater) fetchFromPeers(ctx context.Context) ([]byte, error) {
+	fetcher, ok := u.Requester.(ArtifactFetcher)
+	if !ok {
+		return nil, ErrNoPeerArtifact
+	}
+	bin, err := fetcher.FetchArtifact(ctx, u.Info.ContentHash)
 	if err != nil {
 		return nil, err
 	}
@@ -225,58 +533,144 @@ func (u *Updater) fetchAndVerifyPatch(old io.Reader) ([]byte, error) {
 	return bin, nil
 }
 
-func (u *Updater) fetchAndVerifyFullBin() ([]byte, error) {
-	bin, err := u.fetchBin()
+// publish keeps the verified binary in the cache and hands it to the
+// requester if it keeps them.
+func (u *Updater) publish(bin []byte) {
+	if u.Cache != nil {
+		if err := u.Cache.Put(u.Info.ContentHash, bin); err != nil {
+			u.logger().Log(zapcore.WarnLevel, "update: caching artifact failed",
+				zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+		}
+	}
+	publisher, ok := u.Requester.(ArtifactPublisher)
+	if !ok {
+		return
+	}
+	if err := publisher.PublishArtifact(u.Info.ContentHash, bin); err != nil {
+		u.logger().Log(zapcore.WarnLevel, "update: keeping artifact for peers failed",
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	}
+}
+
+func (u *Updater) fetchAndVerifyPatch(ctx context.Context, old io.Reader, onProgress func(Progress)) ([]byte, error) {
+	oldBytes, err := io.ReadAll(old)
+	if err != nil {
+		return nil, err
+	}
+	oldHash := sha256.Sum256(oldBytes)
+	if len(u.Info.Patches) > 0 {
+		return u.fetchAndVerifyPatchChain(ctx, oldBytes, oldHash[:], onProgress)
+	}
+	if !u.Info.IsPatch {
+		return nil, errNoPatch
+	}
+	// without a patch graph the patch sits next to the artifact, named
+	// after the binary it applies to, so a mismatching one is never fetched
+	edge := PatchEdge{From: oldHash[:], To: u.Info.ContentHash}
+	return u.applyPatchEdge(ctx, oldBytes, edge, func(mirror string) string {
+		return sourcePatchURL(mirror, oldHash[:])
+	}, onProgress)
+}
+
+func (u *Updater) fetchAndVerifyFullBin(ctx context.Context, onProgress func(Progress)) ([]byte, error) {
+	if len(u.Info.Chunks) > 0 {
+		bin, err := u.fetchAndVerifyChunked(ctx, onProgress)
+		if err == nil {
+			return bin, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		u.logger().Log(zapcore.WarnLevel, "update: chunked download failed, falling back to a single stream",
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	}
+	return u.withMirrors(ctx, "", func(url string) ([]byte, error) {
+		bin, err := u.fetchBin(ctx, url, onProgress)
+		if err != nil {
+			return nil, err
+		}
+		verified := verifySha(bin, u.Info.ContentHash)
+		if !verified {
+			return nil, ErrHashMismatch
+		}
+		return bin, nil
+	})
+}
+
+// fetchAndVerifyChunked downloads the ranges listed in Info.Chunks in
+// parallel from all mirrors.
+func (u *Updater) fetchAndVerifyChunked(ctx context.Context, onProgress func(Progress)) ([]byte, error) {
+	requester, ok := u.Requester.(RangeRequester)
+	if !ok {
+		return nil, errors.New("requester does not support ranges")
+	}
+	var mirrors []string
+	for _, m := range u.mirrorHealth(ctx).order(u.Info.mirrors()) {
+		mirrors = append(mirrors, m.Url)
+	}
+	d := &chunkedDownload{
+		requester:   requester,
+		mirrors:     mirrors,
+		chunks:      u.Info.Chunks,
+		concurrency: u.ChunkConcurrency,
+		policy:      u.retryPolicy(),
+		onProgress:  onProgress,
+	}
+	artifact, err := d.run(ctx)
 	if err != nil {
 		return nil, err
 	}
-	verified := verifySha(bin, u.Info.ContentHash)
-	if !verified {
+	bin, err := u.decode(bytes.NewReader(artifact))
+	if err != nil {
+		return nil, err
+	}
+	if !verifySha(bin, u.Info.ContentHash) {
 		return nil, ErrHashMismatch
 	}
 	return bin, nil
 }
 
-func (u *Updater) fetchAndApplyPatch(old io.Reader) ([]byte, error) {
-	r, err := u.fetch(u.Info.DownloadUrl + ".patch")
+func (u *Updater) fetchPatch(ctx context.Context, url string, onProgress func(Progress)) ([]byte, error) {
+	r, err := u.fetch(ctx, url)
 	if err != nil {
 		return nil, err
 	}
+	r = newProgressReader(r, "patch", url, onProgress)
 	defer r.Close()
-	var buf bytes.Buffer
-	err = binarydist.Patch(old, &buf, r)
-	return buf.Bytes(), err
+	return io.ReadAll(r)
 }
 
-func (u *Updater) fetchBin() ([]byte, error) {
-	r, err := u.fetch(u.Info.DownloadUrl)
+func (u *Updater) fetchBin(ctx context.Context, url string, onProgress func(Progress)) ([]byte, error) {
+	r, err := u.fetch(ctx, url)
 	if err != nil {
 		return nil, err
 	}
+	r = newProgressReader(r, "full", url, onProgress)
 	defer r.Close()
+	return u.decode(r)
+}
+
+// decode undoes the artifact's compression, as named by the manifest or
+// else recognised from its magic bytes. Bundles are kept as they are,
+// their format includes the compression.
+func (u *Updater) decode(r io.Reader) ([]byte, error) {
 	buf := new(bytes.Buffer)
-	if u.IsGzipped {
-		gz, err := gzip.NewReader(r)
-		if err != nil {
-			return nil, err
-		}
-		if _, err = io.Copy(buf, gz); err != nil {
-			return nil, err
-		}
-	} else {
-		if _, err = io.Copy(buf, r); err != nil {
-			return nil, err
-		}
+	compression := u.Info.Compression
+	if u.Info.Bundle != nil {
+		compression = CompressionNone
+	}
+	if err := decompress(buf, r, compression); err != nil {
+		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-func (u *Updater) fetch(url string) (io.ReadCloser, error) {
+func (u *Updater) fetch(ctx context.Context, url string) (io.ReadCloser, error) {
 	if u.Requester == nil {
-		return defaultHTTPRequester.Fetch(url)
+		return defaultHTTPRequester.FetchContext(ctx, url)
 	}
 
-	readCloser, err := u.Requester.Fetch(url)
+	readCloser, err := WithContext(u.Requester).FetchContext(ctx, url)
 	if err != nil {
 		return nil, err
 	}
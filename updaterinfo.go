@@ -2,9 +2,62 @@ package opamppackagemgm
 
 type UpdatePackageInfo struct {
 	Version        string
-	DownloadUrl    string `json:"download_url,omitempty"`
-	ContentHash    []byte `json:"content_hash,omitempty"`
-	Signature      []byte `json:"signature,omitempty"`
-	CurrentVersion string `json:"current_version,omitempty"`
-	IsPatch        bool   `json:"is_patch,omitempty"`
+	DownloadUrl    string      `json:"download_url,omitempty"`
+	Mirrors        []Mirror    `json:"mirrors,omitempty"`
+	Chunks         []Chunk     `json:"chunks,omitempty"`
+	ContentHash    []byte      `json:"content_hash,omitempty"`
+	Signature      []byte      `json:"signature,omitempty"`
+	CurrentVersion string      `json:"current_version,omitempty"`
+	IsPatch        bool        `json:"is_patch,omitempty"`
+	FileAttrs      *FileAttrs  `json:"file_attrs,omitempty"`
+	Bundle         *Bundle     `json:"bundle,omitempty"`      // set when the artifact is an archive of several files
+	Compression    string      `json:"compression,omitempty"` // CompressionGzip, CompressionZstd, CompressionXz or CompressionNone, recognised from the artifact when empty
+	Patches        []PatchEdge `json:"patches,omitempty"`     // patch graph keyed by source hash, used instead of the patch next to the artifact when set
+	Hooks          *Hooks      `json:"hooks,omitempty"`
+}
+
+// FileAttrs is an explicit policy for the installed executable. Fields left
+// unset are copied from the executable being replaced.
+type FileAttrs struct {
+	Mode   *uint32           `json:"mode,omitempty"` // permission bits including setuid/setgid, ex: 0o4755
+	Uid    *int              `json:"uid,omitempty"`
+	Gid    *int              `json:"gid,omitempty"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"` // ex: security.capability, an empty value removes the attribute
+}
+
+// Mirror is an alternative location of the artifact. Mirrors with a higher
+// weight are preferred among mirrors of equal health; a zero weight counts
+// as 1.
+type Mirror struct {
+	Url    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// mirrors returns DownloadUrl followed by the listed mirrors, without
+// duplicates.
+func (i *UpdatePackageInfo) mirrors() []Mirror {
+	var out []Mirror
+	seen := make(map[string]bool)
+	if i.DownloadUrl != "" {
+		out = append(out, Mirror{Url: i.DownloadUrl})
+		seen[i.DownloadUrl] = true
+	}
+	for _, m := range i.Mirrors {
+		if m.Url == "" || seen[m.Url] {
+			continue
+		}
+		seen[m.Url] = true
+		out = append(out, m)
+	}
+	return out
+}
+
+// artifactSize is the size of the full artifact if the chunk list tells it,
+// otherwise 0.
+func (i *UpdatePackageInfo) artifactSize() int64 {
+	var size int64
+	for _, c := range i.Chunks {
+		size += c.Size
+	}
+	return size
 }
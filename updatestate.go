@@ -0,0 +1,191 @@
+package opamppackagemgm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// UpdateState is a step of an update. The step reached is persisted in the
+// updater's StateStore after every transition, so that an update interrupted by a crash or a
+// power cut is resumed or rolled back when BackgroundRun starts again.
+type UpdateState string
+
+const (
+	StateOffered     UpdateState = "offered"     // Info names a version to install
+	StateDownloading UpdateState = "downloading" // fetching from the cache, peers, patches or mirrors
+	StateDownloaded  UpdateState = "downloaded"  // the new version is in memory
+	StateVerified    UpdateState = "verified"    // its hash matched and it is kept in the cache
+	StateStaged      UpdateState = "staged"      // written next to its target, about to be swapped in
+	StateSwapped     UpdateState = "swapped"     // installed, the post-install hook hasn't passed yet
+	StateConfirmed   UpdateState = "confirmed"   // done, the previous version is dropped
+)
+
+// updateRecord is the persisted progress of the update in flight.
+type updateRecord struct {
+	State      UpdateState       `json:"state"`
+	From       string            `json:"from"`
+	Info       UpdatePackageInfo `json:"info"`
+	Executable string            `json:"executable,omitempty"`
+	Target     string            `json:"target,omitempty"` // what is swapped: the executable, the bundle directory or the slot
+	Changed    time.Time         `json:"changed"`
+}
+
+// UpdateState returns the state of the last update, "" if none was
+// recorded or the last one failed cleanly. A damaged record is reported
+// with an error wrapping ErrStateCorrupt, once, and then forgotten.
+func (u *Updater) UpdateState() (UpdateState, error) {
+	rec, err := u.loadUpdateRecord()
+	if err != nil || rec == nil {
+		return "", err
+	}
+	return rec.State, nil
+}
+
+// begin starts recording the update offered in Info.
+func (u *Updater) begin() {
+	u.inFlight = &updateRecord{From: u.CurrentVersion, Info: u.Info}
+	u.advance(StateOffered)
+}
+
+// oldVersion returns the version the update in flight replaces. A resumed
+// update started under the previous process, which is likely running the
+// new version now.
+func (u *Updater) oldVersion() string {
+	if u.inFlight != nil {
+		return u.inFlight.From
+	}
+	return u.CurrentVersion
+}
+
+// advance persists state for the update in flight. Failing to do so is
+// logged, it only makes a later recovery less precise.
+func (u *Updater) advance(state UpdateState) {
+	rec := u.inFlight
+	if rec == nil {
+		return
+	}
+	rec.State = state
+	rec.Changed = time.Now()
+	if err := u.saveUpdateRecord(rec); err != nil {
+		u.logger().Log(zapcore.WarnLevel, "update: persisting the update state failed",
+			zapcore.Field{Key: "state", Type: zapcore.StringType, String: string(state)},
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	}
+}
+
+// stage records that target is about to be swapped.
+func (u *Updater) stage(target string) {
+	if u.inFlight != nil {
+		u.inFlight.Target = target
+	}
+	u.advance(StateStaged)
+}
+
+// end closes the update in flight: confirmed on success, forgotten on a
+// failure that left the previous version in place, which the history
+// journal records.
+func (u *Updater) end(err error) {
+	if u.inFlight == nil {
+		return
+	}
+	if err == nil {
+		u.advance(StateConfirmed)
+	} else if err := u.store().Delete(StateKeyUpdate); err != nil {
+		u.logger().Log(zapcore.WarnLevel, "update: clearing the update state failed",
+			zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	}
+	u.inFlight = nil
+}
+
+// resume picks up an update that was interrupted:
+//
+//   - before it was staged it is started again; a verified binary is found
+//     in the cache and not downloaded twice,
+//   - staged, it is started again unless the swap went through, which is
+//     told by the version now running,
+//   - swapped, the post-install hook runs again and confirms the update or
+//     rolls it back. The record is read again once the update lock is
+//     held, another updater may have confirmed it meanwhile.
+//
+// An update overtaken by another install is forgotten.
+func (u *Updater) resume() error {
+	rec, err := u.loadUpdateRecord()
+	if err != nil || rec == nil || rec.State == StateConfirmed {
+		return err
+	}
+	state := rec.State
+	if state == StateStaged && u.CurrentVersion == rec.Info.Version {
+		state = StateSwapped
+	}
+	u.logger().Log(zapcore.InfoLevel, "update: resuming an interrupted update",
+		zapcore.Field{Key: "state", Type: zapcore.StringType, String: string(rec.State)},
+		zapcore.Field{Key: "version", Type: zapcore.StringType, String: rec.Info.Version})
+
+	if state == StateSwapped {
+		lock, err := u.lockUpdate(u.context())
+		if err != nil {
+			return err
+		}
+		defer lock.unlock()
+		// another updater may have finished the update while we waited
+		if rec, err = u.loadUpdateRecord(); err != nil || rec == nil || rec.State == StateConfirmed {
+			return err
+		}
+		if rec.State != StateSwapped && (rec.State != StateStaged || u.CurrentVersion != rec.Info.Version) {
+			return nil
+		}
+		u.Info = rec.Info
+		u.inFlight = rec
+		e := HistoryEntry{Time: time.Now(), From: rec.From, To: rec.Info.Version, Outcome: OutcomeSucceeded}
+		err = u.postInstall(u.context(), rec.Executable, rec.Target)
+		e.Duration = time.Since(e.Time)
+		if err != nil {
+			e.Outcome, e.Error = OutcomeRolledBack, err.Error()
+		}
+		u.end(err)
+		u.record(e)
+		return err
+	}
+	if rec.From != u.CurrentVersion {
+		return u.store().Delete(StateKeyUpdate)
+	}
+	u.Info = rec.Info
+	return u.Update()
+}
+
+// loadUpdateRecord returns the persisted record, nil if there is none. A
+// damaged record is dropped, nothing can be resumed from it, and reported.
+func (u *Updater) loadUpdateRecord() (*updateRecord, error) {
+	p, err := u.store().Get(StateKeyUpdate)
+	if errors.Is(err, ErrStateNotFound) {
+		return nil, nil
+	}
+	rec := &updateRecord{}
+	if err == nil {
+		if err = json.Unmarshal(p, rec); err == nil {
+			return rec, nil
+		}
+		err = fmt.Errorf("%s: %w: %v", StateKeyUpdate, ErrStateCorrupt, err)
+	}
+	if !errors.Is(err, ErrStateCorrupt) {
+		return nil, err
+	}
+	u.logger().Log(zapcore.ErrorLevel, "update: dropping a damaged update state",
+		zapcore.Field{Key: "error", Type: zapcore.ErrorType, Interface: err})
+	if delErr := u.store().Delete(StateKeyUpdate); delErr != nil {
+		return nil, errors.Join(err, delErr)
+	}
+	return nil, err
+}
+
+func (u *Updater) saveUpdateRecord(rec *updateRecord) error {
+	p, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return u.store().Put(StateKeyUpdate, p)
+}
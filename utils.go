@@ -3,9 +3,6 @@ package opamppackagemgm
 import (
 	"bytes"
 	"crypto/sha256"
-	"io/ioutil"
-	"os"
-	"time"
 )
 
 func verifySha(bin []byte, sha []byte) bool {
@@ -13,22 +10,3 @@ func verifySha(bin []byte, sha []byte) bool {
 	h.Write(bin)
 	return bytes.Equal(h.Sum(nil), sha)
 }
-
-func readTime(path string) time.Time {
-	p, err := ioutil.ReadFile(path)
-	if os.IsNotExist(err) {
-		return time.Time{}
-	}
-	if err != nil {
-		return time.Now().Add(1 * time.Hour)
-	}
-	t, err := time.Parse(time.RFC3339, string(p))
-	if err != nil {
-		return time.Now().Add(1 * time.Hour)
-	}
-	return t
-}
-
-func writeTime(path string, t time.Time) bool {
-	return ioutil.WriteFile(path, []byte(t.Format(time.RFC3339)), 0644) == nil
-}